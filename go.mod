@@ -7,6 +7,5 @@ require (
 	github.com/xpwu/go-config v0.1.0
 	github.com/xpwu/go-db-redis v0.1.0
 	github.com/xpwu/go-log v0.1.0
-	github.com/xpwu/go-reqid v0.1.0
 	github.com/xpwu/go-tinyserver v0.1.0
 )
@@ -3,8 +3,10 @@ package tapi
 import (
   "context"
   "encoding/json"
+  "errors"
   "fmt"
   "github.com/xpwu/go-api-token/token"
+  "github.com/xpwu/go-api-token/token/db"
   "github.com/xpwu/go-log/log"
   "github.com/xpwu/go-tinyserver/api"
   "net/http"
@@ -12,6 +14,7 @@ import (
 
 /**
  在需要用到token的suit中，应该嵌入 PostJsonAPI ，其登录接口的suit需要嵌入 PostJsonLoginAPI
+ 配置了 sliding 时，PostJsonAPI 验证 token 之后自动刷新其 TTL 及 LatestTime，见 token/db/sliding.go
  */
 
 type PostJsonAPI struct {
@@ -52,21 +55,34 @@ func (a *PostJsonAPI) SetUp(ctx context.Context, r *api.Request, apiReq interfac
   }
 
   tk := rData.Token
-  uid, ok := "", false
+  uid, err := "", error(nil)
+  errCode := code(TokenExpireCode)
 
   if tk == "" {
     logger.Error("request has no 'token'")
-    goto _401
+    goto _error
   }
 
   a.Token = token.Resume(ctx, tk)
-  uid, ok = a.Token.UidOrInvalid()
-  if !ok {
-    logger.Error(fmt.Sprintf("token(%s) error or expire", tk))
-    goto _401
+  uid, err = a.Token.UidOrInvalidWithErr()
+  if errors.Is(err, token.ErrStoreUnavailable) {
+    logger.Error(fmt.Sprintf("token(%s) can not be verified, %s", tk, err))
+    errCode = StoreUnavailableCode
+    goto _error
+  }
+  if err != nil {
+    logger.Error(fmt.Sprintf("token(%s) error or expire, %s", tk, err))
+    errCode = tokenErrorCode(err)
+    goto _error
   }
 
   logger.PushPrefix("uid=" + uid)
+
+  // 滑动过期，失败时不影响本次请求
+  if err := a.Token.SlideWithErr(); err != nil {
+    logger.Warning(fmt.Sprintf("slide token(%s) error, %s", tk, err))
+  }
+
   a.UidContext = ctx
   a.Request = r
 
@@ -77,10 +93,10 @@ func (a *PostJsonAPI) SetUp(ctx context.Context, r *api.Request, apiReq interfac
 
   return true
 
-  // 401
-_401:
+  // 401、4011~4014 or 503
+_error:
   resp := Response{
-    Code: TokenExpireCode,
+    Code: errCode,
     Data: struct {
     }{},
   }
@@ -99,6 +115,30 @@ _401:
   return false
 }
 
+// tokenErrorCode token 无效时返回给客户端的 code
+func tokenErrorCode(err error) code {
+  if errors.Is(err, token.ErrStoreUnavailable) {
+    return StoreUnavailableCode
+  }
+
+  var revoked *db.RevokedError
+  if !errors.As(err, &revoked) {
+    return TokenExpireCode
+  }
+
+  switch revoked.Tombstone.Reason {
+  case db.ReasonEvicted:
+    return TokenEvictedCode
+  case db.ReasonReplaced:
+    return TokenReplacedCode
+  case db.ReasonExclusive:
+    return TokenExclusiveCode
+  case db.ReasonSignedOut:
+    return TokenSignedOutCode
+  }
+  return TokenExpireCode
+}
+
 func (a *PostJsonAPI) Logout() {
   _, logger := log.WithCtx(a.UidContext)
   logger.PushPrefix("logout token")
@@ -0,0 +1,67 @@
+package tapi
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "github.com/xpwu/go-api-token/token"
+  "github.com/xpwu/go-log/log"
+  "github.com/xpwu/go-tinyserver/api"
+  "time"
+)
+
+/**
+  发布 JWT 的公钥(JWKS)，供其他服务使用 token.JWKSVerifier 验证，例如：
+    api.Add(tapi.NewJWKSSuite("/.well-known", 5*time.Minute))
+  对应的 uri 为 /.well-known/jwks 及 /.well-known/Jwks，GET 或者 POST 均可
+*/
+
+type JWKSRequest struct {
+}
+
+type JWKSSuite struct {
+  preUri string
+  maxAge time.Duration
+}
+
+// NewJWKSSuite maxAge 为响应中 Cache-Control 的 max-age，key 轮换时，新的 key 至少应提前 maxAge 加入 KeyRing
+func NewJWKSSuite(preUri string, maxAge time.Duration) api.SuiteCreator {
+  return func() api.Suite {
+    return &JWKSSuite{preUri: preUri, maxAge: maxAge}
+  }
+}
+
+func (s *JWKSSuite) MappingPreUri() string {
+  return s.preUri
+}
+
+// SetUp 不需要请求数据
+func (s *JWKSSuite) SetUp(ctx context.Context, r *api.Request, apiReq interface{}) bool {
+  return true
+}
+
+// APIJwks 没有配置 JWT 时返回空的 JWKS
+func (s *JWKSSuite) APIJwks(ctx context.Context, req *JWKSRequest) *token.JWKS {
+  _, logger := log.WithCtx(ctx)
+
+  ring, err := token.JWTKeyRing()
+  if err != nil {
+    logger.Error(err)
+    return &token.JWKS{Keys: make([]token.JWK, 0)}
+  }
+  return ring.JWKS(time.Now())
+}
+
+func (s *JWKSSuite) TearDown(ctx context.Context, apiRes interface{}, res *api.Response) {
+  _, logger := log.WithCtx(ctx)
+
+  var err error
+  res.RawData, err = json.Marshal(apiRes)
+  if err != nil {
+    logger.Error(err)
+    res.Request().Terminate(err)
+  }
+
+  res.Header.Set("Content-Type", "application/jwk-set+json")
+  res.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(s.maxAge/time.Second)))
+}
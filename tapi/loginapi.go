@@ -18,7 +18,9 @@ type PostJsonLoginAPI struct {
   success bool
   Token   *token.Token
   Request *api.Request
-  value   *db.Value
+  uid     string
+  // 只有 SucceedWithPair 才有
+  pair *token.Pair
 }
 
 func (l *PostJsonLoginAPI) SetUp(ctx context.Context, r *api.Request, apiReq interface{}) bool {
@@ -42,22 +44,65 @@ func (l *PostJsonLoginAPI) SetUp(ctx context.Context, r *api.Request, apiReq int
   return true
 }
 
+// Succeed token 为业务已经生成的 token，包括签名的 token(存储中没有 Value)，uid 由 token 验证得到。
+// token 无效或者存储不可用时终止请求
 func (l *PostJsonLoginAPI) Succeed(token *token.Token) {
+  uid, err := token.UidOrInvalidWithErr()
+  if err != nil {
+    l.Request.Terminate(err)
+  }
   l.success = true
   l.Token = token
-  l.value, _ = token.DB.Value()
+  l.uid = uid
 }
 
 func (l *PostJsonLoginAPI) SucceedAndOverWrite(ctx context.Context, value db.Value) {
   l.success = true
   l.Token = token.New(ctx, value)
-  l.value = &value
+  l.uid = value.Uid
 }
 
 func (l *PostJsonLoginAPI) SucceedAndSetOrUseOld(ctx context.Context, value db.Value) {
   l.success = true
   l.Token = token.NewOrUseOld(ctx, value)
-  l.value = &value
+  l.uid = value.Uid
+}
+
+// SucceedExclusive 与 SucceedAndOverWrite 相同，同时撤销 uid 在 group 中其他 ClientId 的 token，
+// 比如只允许一部手机登录，被撤销的 token 见 l.Token.Evicted()。SucceedAndSetOrUseOld、SucceedWithPair 同样遵守 value.Exclusive
+func (l *PostJsonLoginAPI) SucceedExclusive(ctx context.Context, value db.Value, group string) {
+  value.Exclusive = group
+  l.SucceedAndOverWrite(ctx, value)
+}
+
+// SucceedStateless 返回无状态的 token，见 token.NewStateless。没有配置 stateless.secret 时终止请求
+func (l *PostJsonLoginAPI) SucceedStateless(ctx context.Context, value db.Value) {
+  tk, err := token.NewStatelessWithErr(ctx, value)
+  if err != nil {
+    l.Request.Terminate(err)
+  }
+  l.success = true
+  l.Token = tk
+  l.uid = value.Uid
+}
+
+// SucceedJWT 返回 JWT，见 token.NewJWT。没有配置 JWT 的 key 时终止请求
+func (l *PostJsonLoginAPI) SucceedJWT(ctx context.Context, value db.Value) {
+  tk, err := token.NewJWTWithErr(ctx, value)
+  if err != nil {
+    l.Request.Terminate(err)
+  }
+  l.success = true
+  l.Token = tk
+  l.uid = value.Uid
+}
+
+// SucceedWithPair 返回 access token 及 refresh token，见 token.NewPair
+func (l *PostJsonLoginAPI) SucceedWithPair(ctx context.Context, value db.Value) {
+  l.success = true
+  l.pair = token.NewPair(ctx, value)
+  l.Token = l.pair.Access
+  l.uid = value.Uid
 }
 
 func (l *PostJsonLoginAPI) TearDown(ctx context.Context, apiRes interface{}, res *api.Response) {
@@ -69,9 +114,14 @@ func (l *PostJsonLoginAPI) TearDown(ctx context.Context, apiRes interface{}, res
     Data:  apiRes,
   }
   if l.success {
-    rData.Uid = l.value.Uid
+    rData.Uid = l.uid
     rData.Token = l.Token.Id()
   }
+  if l.success && l.pair != nil {
+    rData.TokenExpiresAt = l.pair.AccessExpiresAt.Unix()
+    rData.RefreshToken = l.pair.Refresh.Id()
+    rData.RefreshTokenExpiresAt = l.pair.RefreshExpiresAt.Unix()
+  }
 
   var err error
   res.RawData, err = json.Marshal(rData)
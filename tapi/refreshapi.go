@@ -0,0 +1,60 @@
+package tapi
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-api-token/token"
+  "github.com/xpwu/go-log/log"
+  "github.com/xpwu/go-tinyserver/api"
+)
+
+/**
+  使用 refresh token 换取新的 access token，同时 refresh token 轮换为新的，客户端需要保存新的 refresh token。例如：
+    api.Add(tapi.NewRefreshSuite("/token"))
+  对应的 uri 为 /token/refresh 及 /token/Refresh。请求及响应见 RefreshRequest、RefreshResponse，
+  code 与 PostJsonAPI 的相同(见 tokenErrorCode)，除 StoreUnavailableCode 外客户端都需要重新登录：
+    TokenExpireCode(401)：refresh token 无效、过期或者重复使用
+    TokenEvictedCode(4011)、TokenReplacedCode(4012)、TokenExclusiveCode(4013)、TokenSignedOutCode(4014)：
+      已经被淘汰、被同一个 ClientId 的登录替换、被互斥的登录撤销或者被删除，见 token/db/tombstone.go
+    StoreUnavailableCode(503)：存储不可用，不能验证，客户端可以稍后重试
+*/
+
+type RefreshSuite struct {
+  api.PostJsonSetUpper
+  api.PostJsonTearDowner
+  preUri string
+}
+
+func NewRefreshSuite(preUri string) api.SuiteCreator {
+  return func() api.Suite {
+    return &RefreshSuite{preUri: preUri}
+  }
+}
+
+func (s *RefreshSuite) MappingPreUri() string {
+  return s.preUri
+}
+
+func (s *RefreshSuite) APIRefresh(ctx context.Context, req *RefreshRequest) *RefreshResponse {
+  ctx, logger := log.WithCtx(ctx)
+
+  pair, err := token.RefreshWithErr(ctx, req.RefreshToken)
+  if errors.Is(err, token.ErrStoreUnavailable) {
+    logger.Error(fmt.Sprintf("refresh token(%s) can not be verified, %s", req.RefreshToken, err))
+    return &RefreshResponse{Code: StoreUnavailableCode}
+  }
+  if err != nil {
+    logger.Error(fmt.Sprintf("refresh token(%s) error or expire, %s", req.RefreshToken, err))
+    return &RefreshResponse{Code: tokenErrorCode(err)}
+  }
+
+  return &RefreshResponse{
+    Code:                  Success,
+    Uid:                   pair.Refresh.Uid(),
+    Token:                 pair.Access.Id(),
+    TokenExpiresAt:        pair.AccessExpiresAt.Unix(),
+    RefreshToken:          pair.Refresh.Id(),
+    RefreshTokenExpiresAt: pair.RefreshExpiresAt.Unix(),
+  }
+}
@@ -17,7 +17,7 @@ Request：
 
 Response：
   {
-    "code": 200/401,
+    "code": 200/401/4011/4012/4013/4014/503,
     "data": {
             }
   }
@@ -32,9 +32,28 @@ LoginResponse：
   {
     "uid": "xxxx",
     "token": "xxxx",
+    "tokenExpiresAt": 1700000000,
+    "refreshToken": "xxxx",
+    "refreshTokenExpiresAt": 1700000000,
     "data": {
             }
   }
+  只有 SucceedWithPair 才返回 tokenExpiresAt、refreshToken、refreshTokenExpiresAt，此时 token 为 access token
+
+RefreshRequest：
+  {
+    "refreshToken": "xxxx"
+  }
+
+RefreshResponse：
+  {
+    "code": 200/401/4011/4012/4013/4014/503,
+    "uid": "xxxx",
+    "token": "xxxx",
+    "tokenExpiresAt": 1700000000,
+    "refreshToken": "xxxx",
+    "refreshTokenExpiresAt": 1700000000
+  }
 
 */
 
@@ -50,6 +69,18 @@ type code int
 const (
   Success         code = 200
   TokenExpireCode      = 401
+  // 鉴权服务暂时不可用，token 本身可能是有效的，客户端应稍后重试，而不是重新登录
+  StoreUnavailableCode = 503
+
+  // token 已经被撤销，客户端同样需要重新登录，但可以提示具体的原因，见 token/db/tombstone.go
+  // 设备数达到限制被淘汰
+  TokenEvictedCode = 4011
+  // 同一个 ClientId 重新登录
+  TokenReplacedCode = 4012
+  // 在同一互斥分组的其他设备上登录，比如另一部手机
+  TokenExclusiveCode = 4013
+  // 被删除，比如管理员踢下线
+  TokenSignedOutCode = 4014
 )
 
 type Response struct {
@@ -68,7 +99,26 @@ type LoginResponse struct {
   Uid string `json:"uid"`
   // 登录失败，则 token是 "", 可用于判断是否登录成功
   Token string `json:"token"`
+  // unix 秒
+  TokenExpiresAt        int64  `json:"tokenExpiresAt,omitempty"`
+  RefreshToken          string `json:"refreshToken,omitempty"`
+  RefreshTokenExpiresAt int64  `json:"refreshTokenExpiresAt,omitempty"`
 
   // 上层接口需要返回给客户端的数据
   Data interface{} `json:"data"`
 }
+
+type RefreshRequest struct {
+  RefreshToken string `json:"refreshToken"`
+}
+
+type RefreshResponse struct {
+  Code code   `json:"code"`
+  Uid  string `json:"uid"`
+  // 新的 access token
+  Token string `json:"token"`
+  // unix 秒
+  TokenExpiresAt        int64  `json:"tokenExpiresAt"`
+  RefreshToken          string `json:"refreshToken"`
+  RefreshTokenExpiresAt int64  `json:"refreshTokenExpiresAt"`
+}
@@ -0,0 +1,72 @@
+package token
+
+import (
+	"github.com/xpwu/go-config/configs"
+)
+
+type jwtKeyConfig struct {
+	Kid       string `conf:"kid"`
+	Secret    string `conf:"secret, for HS256"`
+	File      string `conf:"file, PEM, RS256/ES256 is decided by the key, a public key verifies only"`
+	NotBefore string `conf:"notBefore, RFC3339, activated to sign at the time. empty: now"`
+}
+
+type config struct {
+	Id struct {
+		Bytes    int    `conf:"bytes, random bytes of the token id"`
+		Encoding string `conf:"encoding, hex, base64url or base32"`
+	} `conf:"id"`
+	Format struct {
+		Prefix            string `conf:"prefix, token: <prefix>_v1_<random>_<crc32>. empty: random only"`
+		AcceptUnformatted bool   `conf:"acceptUnformatted, accept the tokens without the prefix issued before setting it"`
+	} `conf:"format"`
+	Stateless struct {
+		Secret          string `conf:"secret, HMAC-SHA256 key of stateless token"`
+		TTLMinutes      int64  `conf:"ttl, unit:minute"`
+		CheckRevocation bool   `conf:"checkRevocation, check the store whether the token is revoked or issued before not-before when verifying, 2 reads of the store per verifying"`
+	} `conf:"stateless"`
+	Pair struct {
+		AccessTTLMinutes int64 `conf:"accessTTL, unit:minute. the refresh token lives as long as the normal token(maxTTL of db)"`
+	} `conf:"pair, access token + refresh token"`
+	JWT struct {
+		Alg             string         `conf:"alg, HS256, RS256 or ES256"`
+		Secret          string         `conf:"secret, for HS256"`
+		PrivateKeyFile  string         `conf:"privateKeyFile, PEM, for RS256/ES256 to sign"`
+		PublicKeyFile   string         `conf:"publicKeyFile, PEM, for RS256/ES256 to verify only"`
+		Issuer          string         `conf:"issuer"`
+		TTLMinutes      int64          `conf:"ttl, unit:minute"`
+		CheckRevocation bool           `conf:"checkRevocation, check the store whether the token is revoked or issued before not-before when verifying, 2 reads of the store per verifying"`
+		Keys            []jwtKeyConfig `conf:"keys, key ring, the latest activated key signs, the others verify until retired"`
+		KeyDir          string         `conf:"keyDir, every <kid>.pem in the dir is a key activated at its modified time"`
+	} `conf:"jwt"`
+}
+
+var confValue = &config{
+	Id: struct {
+		Bytes    int    `conf:"bytes, random bytes of the token id"`
+		Encoding string `conf:"encoding, hex, base64url or base32"`
+	}{Bytes: 32, Encoding: HexEncoding},
+	Stateless: struct {
+		Secret          string `conf:"secret, HMAC-SHA256 key of stateless token"`
+		TTLMinutes      int64  `conf:"ttl, unit:minute"`
+		CheckRevocation bool   `conf:"checkRevocation, check the store whether the token is revoked or issued before not-before when verifying, 2 reads of the store per verifying"`
+	}{TTLMinutes: 60},
+	Pair: struct {
+		AccessTTLMinutes int64 `conf:"accessTTL, unit:minute. the refresh token lives as long as the normal token(maxTTL of db)"`
+	}{AccessTTLMinutes: 15},
+	JWT: struct {
+		Alg             string         `conf:"alg, HS256, RS256 or ES256"`
+		Secret          string         `conf:"secret, for HS256"`
+		PrivateKeyFile  string         `conf:"privateKeyFile, PEM, for RS256/ES256 to sign"`
+		PublicKeyFile   string         `conf:"publicKeyFile, PEM, for RS256/ES256 to verify only"`
+		Issuer          string         `conf:"issuer"`
+		TTLMinutes      int64          `conf:"ttl, unit:minute"`
+		CheckRevocation bool           `conf:"checkRevocation, check the store whether the token is revoked or issued before not-before when verifying, 2 reads of the store per verifying"`
+		Keys            []jwtKeyConfig `conf:"keys, key ring, the latest activated key signs, the others verify until retired"`
+		KeyDir          string         `conf:"keyDir, every <kid>.pem in the dir is a key activated at its modified time"`
+	}{Alg: HS256, TTLMinutes: 60, Keys: []jwtKeyConfig{}},
+}
+
+func init() {
+	configs.Unmarshal(confValue)
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * access token 与 refresh token：
+ *   refresh token 与普通的 token 相同，占用 uid 的 ClientId，由 OverWrite 写入，Value.RefreshOnly 为 true
+ *   access token 只写入 token ---> Value，不写入 uid 的索引，Value.Refresh 指向其 refresh token，有效期较短
+ *
+ * 删除 access token 时同时删除其 refresh token；删除 refresh token 时，已经发出的 access token 在其有效期内仍然有效，
+ * Reconcile 会清除 refresh token 已经不存在的 access token
+ */
+
+// AccessSetter 支持 access token 的 Store 实现此接口
+type AccessSetter interface {
+  // SetAccess 写入 token ---> value，不写入 uid 的索引
+  SetAccess(ctx context.Context, token string, value *Value, ttl time.Duration) error
+}
+
+var ErrAccessNotSupported = errors.New("token db: the store does not support access token")
+
+func (t *timeoutStore) SetAccess(ctx context.Context, token string, value *Value, ttl time.Duration) error {
+  s, ok := t.Store.(AccessSetter)
+  if !ok {
+    return ErrAccessNotSupported
+  }
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return s.SetAccess(ctx, token, value, ttl)
+  })
+}
+
+// SetAccessWithErr 把 db 作为 refresh 的 access token 写入，value 为 refresh token 的 Value
+func (db *DB) SetAccessWithErr(refresh *DB, value Value, ttl time.Duration) error {
+  _, logger := log.WithCtx(db.ctx)
+
+  value.Refresh = refresh.key
+  value.RefreshOnly = false
+  if max := MaxTTL(value.ClientType); ttl <= 0 || ttl > max {
+    ttl = max
+  }
+  now := time.Now()
+  if ttl = capTTL(ttl, &value, now); ttl <= 0 {
+    return ErrExpired
+  }
+
+  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>access token(%s) of token(%s)", value.Uid,
+    value.ClientId, db.key, refresh.key))
+
+  if err := db.store.(AccessSetter).SetAccess(db.ctx, db.key, &value, ttl); err != nil {
+    return err
+  }
+
+  db.value = &value
+  db.expiresAt = now.Add(ttl)
+  return nil
+}
+
+func (db *DB) SetAccess(refresh *DB, value Value, ttl time.Duration) {
+  _, logger := log.WithCtx(db.ctx)
+  must(logger, db.SetAccessWithErr(refresh, value, ttl))
+}
@@ -5,21 +5,105 @@ import (
 	"github.com/xpwu/go-db-redis/rediscache"
 )
 
+const (
+	redisStoreName        = "redis"
+	redisClusterStoreName = "redis-cluster"
+	memoryStoreName       = "memory"
+)
+
+type clientTypeConfig struct {
+	Type         string `conf:"type, Value.ClientType"`
+	MaxTTL       int64  `conf:"maxTTL, unit:day. 0: the global maxTTL"`
+	AllowDevices struct {
+		Min int64
+		Max int64
+	} `conf:"allowDevices, allow Device count of the type, [min, max)"`
+}
+
 type config struct {
+	Store        string `conf:"store, redis, redis-cluster or memory. memory is only for test or single node"`
 	Redis        rediscache.Config
-	MaxTTL       int64 `conf:"maxTTL, unit:day"`
+	RedisCluster struct {
+		Addrs     []string `conf:"addrs, host:port"`
+		Password  string   `conf:"password"`
+		TimeoutMs int      `conf:"timeout,unit:ms"`
+	} `conf:"redisCluster, used when store is redis-cluster"`
+	Timeout struct {
+		ReadMs  int64 `conf:"read, unit:ms"`
+		WriteMs int64 `conf:"write, unit:ms"`
+	} `conf:"timeout, timeout of every store operation, also the read/write timeout of the redis client, 0: the timeout of redis(redisCluster)"`
+	Degrade struct {
+		FailureThreshold int64 `conf:"failureThreshold, open the circuit after continuous failures, 0: never"`
+		OpenMs           int64 `conf:"open, unit:ms"`
+		CacheSeconds     int64 `conf:"cache, unit:second. uid of the token validated in it can be read when store is unavailable, 0: disable"`
+		CacheSize        int64 `conf:"cacheSize, <=0: 100000"`
+	} `conf:"degrade, when store is unavailable"`
+	HashTokens struct {
+		Secret    string `conf:"secret, store HMAC-SHA256(secret, token) instead of token. empty: store token"`
+		AcceptRaw bool   `conf:"acceptRaw, accept the tokens stored before migrating to hash"`
+	} `conf:"hashTokens"`
+	Tombstone struct {
+		TTLMinutes int64 `conf:"ttl, unit:minute. keep the reason of the evicted, replaced or deleted tokens, 0: disable"`
+	} `conf:"tombstone"`
+	Refresh struct {
+		ReuseWindowMinutes int64 `conf:"reuseWindow, unit:minute. a rotated refresh token is kept for it to detect reuse, 0: delete at once"`
+	} `conf:"refresh, rotation of the refresh token"`
+	NotBefore struct {
+		CacheSeconds int64 `conf:"cache, unit:second. the global not-before is read from the store at most once in it"`
+	} `conf:"notBefore, tokens issued before it are invalid, see SetNotBeforeWithErr"`
+	Sliding struct {
+		Enabled         bool  `conf:"enabled, refresh TTL and LatestTime of the token when it is validated by tapi.PostJsonAPI"`
+		IntervalMinutes int64 `conf:"interval, unit:minute. at most once per interval for every token in every process"`
+		CacheSize       int64 `conf:"cacheSize, tokens remembered for the interval, <=0: 100000"`
+	} `conf:"sliding, sliding expiration"`
+	MaxTTL       int64 `conf:"maxTTL, unit:day. the idle timeout, every refresh of TTL extends the token to it"`
+	AbsoluteTTL  int64 `conf:"absoluteTTL, unit:day. max age of a login regardless of refreshing TTL, 0: unlimited"`
 	AllowDevices struct {
 		Min int64
 		Max int64
 	} `conf:"allowDevices, allow Device count, [min, max)"`
+	ClientTypes []clientTypeConfig `conf:"clientTypes, policies by Value.ClientType, the other types use maxTTL and allowDevices"`
+	Eviction    string             `conf:"eviction, lru, fifo, reject or sameType. the strategy when allowDevices is reached"`
 }
 
 var confValue = &config{
+	Store: redisStoreName,
+	RedisCluster: struct {
+		Addrs     []string `conf:"addrs, host:port"`
+		Password  string   `conf:"password"`
+		TimeoutMs int      `conf:"timeout,unit:ms"`
+	}{Addrs: []string{}, TimeoutMs: 1000},
+	Timeout: struct {
+		ReadMs  int64 `conf:"read, unit:ms"`
+		WriteMs int64 `conf:"write, unit:ms"`
+	}{ReadMs: 500, WriteMs: 1000},
+	Degrade: struct {
+		FailureThreshold int64 `conf:"failureThreshold, open the circuit after continuous failures, 0: never"`
+		OpenMs           int64 `conf:"open, unit:ms"`
+		CacheSeconds     int64 `conf:"cache, unit:second. uid of the token validated in it can be read when store is unavailable, 0: disable"`
+		CacheSize        int64 `conf:"cacheSize, <=0: 100000"`
+	}{FailureThreshold: 5, OpenMs: 3000, CacheSeconds: 60, CacheSize: 100000},
+	Tombstone: struct {
+		TTLMinutes int64 `conf:"ttl, unit:minute. keep the reason of the evicted, replaced or deleted tokens, 0: disable"`
+	}{TTLMinutes: 1440},
+	Refresh: struct {
+		ReuseWindowMinutes int64 `conf:"reuseWindow, unit:minute. a rotated refresh token is kept for it to detect reuse, 0: delete at once"`
+	}{ReuseWindowMinutes: 60},
+	NotBefore: struct {
+		CacheSeconds int64 `conf:"cache, unit:second. the global not-before is read from the store at most once in it"`
+	}{CacheSeconds: 10},
+	Sliding: struct {
+		Enabled         bool  `conf:"enabled, refresh TTL and LatestTime of the token when it is validated by tapi.PostJsonAPI"`
+		IntervalMinutes int64 `conf:"interval, unit:minute. at most once per interval for every token in every process"`
+		CacheSize       int64 `conf:"cacheSize, tokens remembered for the interval, <=0: 100000"`
+	}{IntervalMinutes: 10, CacheSize: 100000},
 	MaxTTL: 90,
 	AllowDevices: struct {
 		Min int64
 		Max int64
 	}{Min: 10, Max: 20},
+	ClientTypes: []clientTypeConfig{},
+	Eviction:    EvictLRU,
 }
 
 func init() {
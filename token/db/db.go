@@ -2,52 +2,40 @@ package db
 
 import (
   "context"
+  "errors"
   "fmt"
-  "github.com/go-redis/redis"
-  "github.com/xpwu/go-db-redis/rediscache"
   "github.com/xpwu/go-log/log"
-  "sort"
   "time"
 )
 
-const (
-  tokenK = "token:"
-  uidK   = "uid:"
-)
-
-func uidKey(uid string) string {
-  return uidK + uid
-}
-
-func tokenKey(token string) string {
-  return tokenK + token
-}
+/**
+ * 以 WithErr 结尾的接口返回错误：数据不存在时返回 ErrNotFound，数据已过期时返回 ErrExpired，
+ * 存储出错时返回的错误满足 errors.Is(err, ErrStoreUnavailable)。
+ * 其他同名的接口是对应 WithErr 接口的包装，存储出错时 panic
+ */
 
 type DB struct {
-  token  string
+  token string
+  // token 在存储中使用的值，见 hash.go
+  key    string
   value  *Value
-  client *redis.Client
+  store  Store
   ctx    context.Context
   maxTTL time.Duration
+  // 写入时淘汰的 token，见 eviction.go
+  evicted []Device
+  // 最近一次写入 TTL 时计算的过期时间
+  expiresAt time.Time
 }
 
-/**
- *
- * 存储方式：
- *
- * tokenKey = 'token:' + token
- *
- * tokenKey ---> Value  (0 < TTL <= config.maxTTL)
- *
- * uidKey = 'uid:' + uid
- *
- * uidKey ---> {ClientId_1:token_1, ClientId_2:token_2, ...}
- *
- * 以 tokenKey 作为判断的标准，写的时候后写，删的时候先删
- *
- */
-
 func New(ctx context.Context, suggestedToken string) *DB {
+  ret := newWithKey(ctx, storageKey(suggestedToken))
+  ret.token = suggestedToken
+  return ret
+}
+
+// newWithKey 由存储中的值生成 DB，hash 保存时不知道 token 本身
+func newWithKey(ctx context.Context, key string) *DB {
   ctx, logger := log.WithCtx(ctx)
   logger.PushPrefix("token db")
 
@@ -58,395 +46,493 @@ func New(ctx context.Context, suggestedToken string) *DB {
 
   ret := &DB{
     ctx:    ctx,
-    token:  suggestedToken,
-    client: rediscache.Get(confValue.Redis),
-    maxTTL: time.Duration(confValue.MaxTTL) * 24 * time.Hour,
+    key:    key,
+    store:  currentStore(),
+    maxTTL: MaxTTL(""),
+  }
+
+  if !isHashed(key) {
+    ret.token = key
   }
-  //if _, err := ret.db.Ping().Result(); err != nil {
-  //  panic(err)
-  //}
 
   return ret
 }
 
+func must(logger *log.Logger, err error) {
+  if err != nil {
+    logger.Error(err)
+    panic(err)
+  }
+}
+
+// mustFound 数据不存在或者过期时返回 false，其他错误 panic
+func mustFound(logger *log.Logger, err error) bool {
+  if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+    return false
+  }
+  must(logger, err)
+  return true
+}
+
+// RealToken hash 保存时，由 Find/FindAll 得到的 DB 返回 ""
 func (db *DB) RealToken() string {
   return db.token
 }
 
-func (db *DB) tokenKey() string {
-  return tokenKey(db.token)
+// ExpiresAt 通过此 DB 最近一次写入 TTL(OverWrite、SetAccess、Rotate、RefreshTTL 等)时实际使用的过期时间，
+// 已经考虑了 ClientType 的 MaxTTL 及 AbsoluteTTL；没有写入过时为零值
+func (db *DB) ExpiresAt() time.Time {
+  return db.expiresAt
 }
 
-func must(logger *log.Logger, err error) {
-  if err != nil && err != redis.Nil {
-    logger.Error(err)
-    panic(err)
+// fallbackToRaw 配置了 HashTokens.AcceptRaw 时，hash 的值不存在，改用 token 本身(迁移前保存的)，
+// 之后的操作都使用 token 本身。客户端传来的 token 本身就是 hash 的值时(比如从存储中得到的)，不能直接使用
+func (db *DB) fallbackToRaw(err error) bool {
+  if !hashEnabled() || !confValue.HashTokens.AcceptRaw || db.token == "" || db.key == db.token {
+    return false
+  }
+  if isHashed(db.token) {
+    return false
   }
+  if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired) {
+    return false
+  }
+
+  db.key = db.token
+  return true
 }
 
-func (db *DB) RefreshTTLto(ttl time.Duration) {
-  if ttl < 0 || ttl > db.maxTTL {
-    ttl = db.maxTTL
+// RefreshTTLtoWithErr 不会超过 ClientType 的 MaxTTL 及 AbsoluteTTL，见 policy.go、lifetime.go
+func (db *DB) RefreshTTLtoWithErr(ttl time.Duration) error {
+  max, err := db.maxTTLWithErr()
+  if err != nil {
+    return err
   }
+  if ttl < 0 || ttl > max {
+    ttl = max
+  }
+
+  ttl, err = db.lifetimeTTL(ttl)
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  if err = db.store.Expire(db.ctx, db.key, ttl); err != nil {
+    return err
+  }
+  db.expiresAt = now.Add(ttl)
+  return nil
+}
 
+func (db *DB) RefreshTTLto(ttl time.Duration) {
   _, logger := log.WithCtx(db.ctx)
-  _, err := db.client.Expire(db.tokenKey(), ttl).Result()
-  must(logger, err)
+  must(logger, db.RefreshTTLtoWithErr(ttl))
+}
+
+// RefreshTTLWithErr 刷新为 ClientType 的 MaxTTL
+func (db *DB) RefreshTTLWithErr() error {
+  return db.RefreshTTLtoWithErr(-1)
 }
 
 func (db *DB) RefreshTTL() {
-  db.RefreshTTLto(db.maxTTL)
+  db.RefreshTTLto(-1)
+}
+
+// RefreshTTLAndLastTimeWithErr TTL 刷新为 ClientType 的 MaxTTL，不会超过 AbsoluteTTL，见 policy.go、lifetime.go
+func (db *DB) RefreshTTLAndLastTimeWithErr(lastTime time.Time) error {
+  max, err := db.maxTTLWithErr()
+  if err != nil {
+    return err
+  }
+
+  ttl, err := db.lifetimeTTL(max)
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  if err = db.store.ExpireAndSetLatestTime(db.ctx, db.key, ttl, lastTime); err != nil {
+    return err
+  }
+  db.expiresAt = now.Add(ttl)
+  return nil
 }
 
 func (db *DB) RefreshTTLAndLastTime(lastTime time.Time) {
   _, logger := log.WithCtx(db.ctx)
+  must(logger, db.RefreshTTLAndLastTimeWithErr(lastTime))
+}
 
-  _, err := db.client.Pipelined(func(pipeliner redis.Pipeliner) error {
-    tokenKey := db.tokenKey()
-    pipeliner.Expire(tokenKey, db.maxTTL)
-    pipeliner.HSet(tokenKey, vLatestTime, encodeLastTime(lastTime))
-    return nil
-  })
-  must(logger, err)
+// UidWithErr 存储不可用时，最近验证过的 token 从本地缓存中读取，见 degrade.go
+func (db *DB) UidWithErr() (uid string, err error) {
+  min := minIssuedAt(time.Now())
+  notBefore := globalNotBefore.get(db.ctx)
+  uid, err = db.store.Uid(db.ctx, db.key, min, notBefore)
+  if db.fallbackToRaw(err) {
+    uid, err = db.store.Uid(db.ctx, db.key, min, notBefore)
+  }
+  if err == nil {
+    recentTokens.add(db.key, uid, "")
+    return
+  }
+
+  if !errors.Is(err, ErrStoreUnavailable) {
+    recentTokens.del(db.key)
+    return "", db.withTombstone(err)
+  }
+
+  if cached, ok := recentTokens.uid(db.key); ok {
+    _, logger := log.WithCtx(db.ctx)
+    logger.Warning(fmt.Sprintf("degrade: use the cached uid(%s) of token(%s), because of %s",
+      cached, db.key, err))
+    return cached, nil
+  }
+
+  return
 }
 
 func (db *DB) Uid() (uid string, ok bool) {
   _, logger := log.WithCtx(db.ctx)
-  uid, err := db.client.HGet(db.tokenKey(), vUid).Result()
-  must(logger, err)
-  if err == nil {
-    return uid, true
+  uid, err := db.UidWithErr()
+  return uid, mustFound(logger, err)
+}
+
+// loadValue 不使用 db.value 的缓存，总是从存储中读取
+func (db *DB) loadValue() (*Value, error) {
+  value, err := db.store.Value(db.ctx, db.key)
+  if db.fallbackToRaw(err) {
+    value, err = db.store.Value(db.ctx, db.key)
   }
+  return value, err
+}
 
-  // err == redis.Nil
-  logger.Warning(fmt.Sprintf("have no token(%s) or the uid not exist", db.token))
-  // 可能是一个没有uid的token，所以做一次清除操作
-  db.client.Del(db.tokenKey())
-  return "", false
+func (db *DB) SessionWithErr() (string, error) {
+  value, err := db.loadValue()
+  if err != nil {
+    return "", err
+  }
+  return value.Session, nil
 }
 
 func (db *DB) Session() string {
   _, logger := log.WithCtx(db.ctx)
-  session, err := db.client.HGet(db.tokenKey(), vSession).Result()
-  must(logger, err)
+  session, err := db.SessionWithErr()
+  mustFound(logger, err)
 
   // not exist, return ZeroValue
   return session
 }
 
+func (db *DB) LastTimeWithErr() (time.Time, error) {
+  value, err := db.loadValue()
+  if err != nil {
+    return decodeLastTime(""), err
+  }
+  return value.LatestTime, nil
+}
+
 func (db *DB) LastTime() time.Time {
   _, logger := log.WithCtx(db.ctx)
-  lTime, err := db.client.HGet(db.tokenKey(), vLatestTime).Result()
-  must(logger, err)
+  lTime, err := db.LastTimeWithErr()
+  mustFound(logger, err)
 
   // not exist, return ZeroValue
-  return decodeLastTime(lTime)
+  return lTime
 }
 
-func (db *DB) OverWrite(value *Value) {
+func (db *DB) OverWriteWithErr(value *Value) error {
   _, logger := log.WithCtx(db.ctx)
-  db.value = value
   logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>token(%s)", value.Uid,
-    value.ClientId, db.token))
-
-  old, err := db.client.HGet(value.uidKey(), value.ClientId).Result()
-  must(logger, err)
-
-  pipeliner := db.client.Pipeline()
+    value.ClientId, db.key))
 
-  // 先删除旧的token
-  if err != redis.Nil {
-    pipeliner.Del(tokenKey(old))
+  // 新的 family，见 family.go
+  if value.RefreshOnly && value.Family == "" {
+    value.Family = db.key
   }
-
-  // 然后写入新的
-  pipeliner.HSet(value.uidKey(), value.ClientId, db.token)
-  pipeliner.HMSet(db.tokenKey(), value.toMap())
-  // 如果失败了，在使用的时候做补偿
-  pipeliner.Expire(db.tokenKey(), db.maxTTL)
-
-  _, err = pipeliner.Exec()
-  must(logger, err)
-  _ = pipeliner.Close()
-
-  // 最后淘汰
-  if eviction(db.ctx, db.client, value.uidKey()) {
-    // 重试一次，如果失败，在获取数据等地方时，补偿
-    eviction(db.ctx, db.client, value.uidKey())
+  if value.IssuedAt.IsZero() {
+    value.IssuedAt = IssuedAtNow()
   }
-}
 
-type intStringSortMap struct {
-  key   []string
-  value []time.Time
-}
+  // 被覆盖的 token 需要记录墓碑(见 tombstone.go)并通知 Observer
+  old := ""
+  if tombstoneTTL() > 0 || Observing() {
+    old, _ = db.store.Find(db.ctx, value.Uid, value.ClientId)
+  }
 
-func (m *intStringSortMap) Len() int {
-  return len(m.value)
-}
+  limit, now := limitOf(value.ClientType), time.Now()
+  evicted, err := db.store.OverWrite(db.ctx, db.key, value, limit)
+  if err != nil {
+    return err
+  }
+  db.expiresAt = now.Add(limit.TTL)
+  recentTokens.delUid(value.Uid, value.ClientId)
+  Notify(db.ctx, &Event{Kind: EventNew, Uid: value.Uid, ClientId: value.ClientId, Token: db.token})
+  db.evicted = onEvicted(db.ctx, value.Uid, value, evicted)
+
+  tombstones := evictedTombstones(value, evicted, time.Now())
+  if old != "" && old != db.key {
+    tombstones[old] = &Tombstone{Reason: ReasonReplaced, Uid: value.Uid, ClientId: value.ClientId,
+      At: time.Now(), By: value.ClientId}
+    Notify(db.ctx, &Event{Kind: EventEvicted, Uid: value.Uid, ClientId: value.ClientId, Token: eventToken(old),
+      Reason: ReasonReplaced})
+  }
+  setTombstones(db.ctx, tombstones)
 
-func (m *intStringSortMap) Less(i, j int) bool {
-  return m.value[i].Before(m.value[j])
+  db.value = value
+  return nil
 }
 
-func (m *intStringSortMap) Swap(i, j int) {
-  m.key[i], m.key[j] = m.key[j], m.key[i]
-  m.value[i], m.value[j] = m.value[j], m.value[i]
+func (db *DB) OverWrite(value *Value) {
+  _, logger := log.WithCtx(db.ctx)
+  must(logger, db.OverWriteWithErr(value))
 }
 
-// todo 使用Lua脚本实现，优化效率
-func eviction(ctx context.Context, redisC *redis.Client, uidKey string) (needRetry bool) {
-  _, logger := log.WithCtx(ctx)
-  l, err := redisC.HLen(uidKey).Result()
-  must(logger, err)
-
-  // 大于 confValue.allowDevices.max 时，做一次token扫描，看是否有无效token, 并强制淘汰早期的token，
-  // 剩余不超过 confValue.allowDevices.max 个
-
-  if l < confValue.AllowDevices.Max {
-    return
+// SetOrUseOldWithErr hash 保存时，无法得到旧的 token，与 OverWriteWithErr 相同
+func (db *DB) SetOrUseOldWithErr(value *Value) error {
+  if hashEnabled() {
+    return db.OverWriteWithErr(value)
   }
 
-  err = redisC.Watch(func(tx *redis.Tx) error {
-    clients, err := redisC.HGetAll(uidKey).Result()
-    must(logger, err)
-    // 再次判读
-    l = int64(len(clients))
-    if l < confValue.AllowDevices.Max {
-      return nil
-    }
-
-    sortMap := intStringSortMap{
-      key:   make([]string, len(clients)),
-      value: make([]time.Time, len(clients)),
-    }
-
-    index := 0
-    pipeliner := redisC.Pipeline()
-    for client, token := range clients {
-      sortMap.key[index] = client
-      pipeliner.HGet(tokenKey(token), vLatestTime)
-      index++
-    }
-    rets, err := pipeliner.Exec()
-    must(logger, err)
-    _ = pipeliner.Close()
-    for i, ret := range rets {
-      must(logger, ret.Err())
-      // 不存在
-      if ret.Err() == redis.Nil {
-        sortMap.value[i] = time.Time{}
-        continue
-      }
-      sortMap.value[i] = decodeLastTime(ret.(*redis.StringCmd).Val())
-    }
-
-    sort.Sort(&sortMap)
-
-    // transaction
-    pipeliner = tx.Pipeline()
-    for _, client := range sortMap.key {
-      pipeliner.Del(tokenKey(clients[client]))
-      pipeliner.HDel(uidKey, client)
-      l--
-      if l <= confValue.AllowDevices.Min {
-        break
-      }
-    }
-    _, err = pipeliner.Exec()
+  _, logger := log.WithCtx(db.ctx)
 
-    if err == redis.TxFailedErr {
-      needRetry = true
-      return nil
-    }
-    must(logger, err)
-    _ = pipeliner.Close()
-    return nil
-  }, uidKey)
-  must(logger, err)
+  if value.IssuedAt.IsZero() {
+    value.IssuedAt = IssuedAtNow()
+  }
+  // 原有的 token 可能已经被 NotBefore 撤销，见 notbefore.go
+  limit := limitOf(value.ClientType)
+  limit.NotBefore = globalNotBefore.get(db.ctx)
+  token, evicted, err := db.store.SetOrUseOld(db.ctx, db.key, value, limit)
+  if err != nil {
+    return err
+  }
+  kind := EventNew
+  if token != db.key {
+    kind = EventReuse
+  }
+  Notify(db.ctx, &Event{Kind: kind, Uid: value.Uid, ClientId: value.ClientId, Token: token})
+  db.evicted = onEvicted(db.ctx, value.Uid, value, evicted)
+  setTombstones(db.ctx, evictedTombstones(value, evicted, time.Now()))
 
-  return
+  db.key = token
+  db.token = token
+  db.value = value
+  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>token(%s)", value.Uid,
+    value.ClientId, db.key))
+  return nil
 }
 
 func (db *DB) SetOrUseOld(value *Value) {
   _, logger := log.WithCtx(db.ctx)
-  ownerKey := value.uidKey()
-  // 先淘汰
-  if eviction(db.ctx, db.client, value.uidKey()) {
-    // 重试一次，如果失败，在获取数据等地方补偿
-    eviction(db.ctx, db.client, value.uidKey())
-  }
-
-  // 必须使用nx 保证并发安全
-  newSet, err := db.client.HSetNX(ownerKey, value.ClientId, db.token).Result()
-  must(logger, err)
-
-  pipeliner := db.client.Pipeline()
-  if !newSet {
-    // 有旧值，使用旧值
-    oldToken, err := db.client.HGet(ownerKey, value.ClientId).Result()
-    must(logger, err)
-    db.token = oldToken
-    pipeliner.HSet(tokenKey(oldToken), vLatestTime, encodeLastTime(value.LatestTime))
-  } else {
-    pipeliner.HMSet(tokenKey(db.token), value.toMap())
-  }
-  pipeliner.Expire(tokenKey(db.token), db.maxTTL)
-  _, err = pipeliner.Exec()
-  must(logger, err)
-  _ = pipeliner.Close()
+  must(logger, db.SetOrUseOldWithErr(value))
+}
 
-  db.value = value
-  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>token(%s)", value.Uid,
-    value.ClientId, db.token))
+func (db *DB) IsValidTokenWithErr() (bool, error) {
+  return db.store.Exists(db.ctx, db.key)
 }
 
 func (db *DB) IsValidToken() bool {
   _, logger := log.WithCtx(db.ctx)
-  ret, err := db.client.Exists(db.tokenKey()).Result()
+  ok, err := db.IsValidTokenWithErr()
   must(logger, err)
-
-  return ret == 1
+  return ok
 }
 
-func (db *DB) Value() (value *Value, ok bool) {
-  _, logger := log.WithCtx(db.ctx)
-
+func (db *DB) ValueWithErr() (*Value, error) {
   if db.value != nil {
-    return db.value, true
+    return db.value, nil
   }
 
-  m, err := db.client.HGetAll(db.tokenKey()).Result()
-  must(logger, err)
-  if err == redis.Nil || len(m) == 0 {
-    return nil, false
+  value, err := db.loadValue()
+  if err != nil {
+    return nil, db.withTombstone(err)
   }
 
-  db.value = fromMap(m)
-  return db.value, true
+  recentTokens.add(db.key, value.Uid, value.ClientId)
+  db.value = value
+  return db.value, nil
+}
+
+func (db *DB) Value() (value *Value, ok bool) {
+  _, logger := log.WithCtx(db.ctx)
+  value, err := db.ValueWithErr()
+  return value, mustFound(logger, err)
+}
+
+func (db *DB) TTLWithErr() (time.Duration, error) {
+  return db.store.TTL(db.ctx, db.key)
 }
 
 func (db *DB) TTL() (ttl time.Duration) {
   _, logger := log.WithCtx(db.ctx)
-  ttl, err := db.client.TTL(db.tokenKey()).Result()
+  ttl, err := db.TTLWithErr()
   must(logger, err)
 
   return
 }
 
-// Del 可重复多次调用
-func (db *DB) Del() {
-  _, logger := log.WithCtx(db.ctx)
-
-  value, ok := db.Value()
-  if !ok {
-    return
+// DelWithErr 可重复多次调用，token 已不存在时返回 nil
+func (db *DB) DelWithErr() error {
+  value, err := db.ValueWithErr()
+  if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+    return nil
+  }
+  if err != nil {
+    return err
   }
 
   log.Info(fmt.Sprintf("del the token(%s) of uid(%s) for clientid(%s)",
-    db.token, value.Uid, value.ClientId))
+    db.key, value.Uid, value.ClientId))
+
+  // access token 同时删除其 refresh token，见 access.go
+  if value.Refresh != "" {
+    if err = db.store.Del(db.ctx, value.Refresh, value); err != nil {
+      return err
+    }
+    recentTokens.del(value.Refresh)
+  }
 
+  if err = db.store.Del(db.ctx, db.key, value); err != nil {
+    return err
+  }
+  recentTokens.del(db.key)
   db.value = nil
-  _, err := db.client.Pipelined(func(pipeliner redis.Pipeliner) error {
-    pipeliner.Del(db.tokenKey())
-    pipeliner.HDel(value.uidKey(), value.ClientId)
-    return nil
-  })
-  must(logger, err)
+  Notify(db.ctx, &Event{Kind: EventDel, Uid: value.Uid, ClientId: value.ClientId, Token: db.token})
+  return nil
 }
 
-func DelClientIdForUid(ctx context.Context, uid string, clientId string) {
-  _, logger := log.WithCtx(ctx)
+// Del 可重复多次调用
+func (db *DB) Del() {
+  _, logger := log.WithCtx(db.ctx)
+  must(logger, db.DelWithErr())
+}
+
+// DelClientIdForUidWithErr 没有对应的 token 时返回 ErrNotFound
+func DelClientIdForUidWithErr(ctx context.Context, uid string, clientId string) error {
+  ctx, logger := log.WithCtx(ctx)
   logger.PushPrefix("token db")
 
-  db := rediscache.Get(confValue.Redis)
-  token, err := db.HGet(uidKey(uid), clientId).Result()
-  must(logger, err)
-  if err == redis.Nil {
+  token, err := currentStore().DelClientId(ctx, uid, clientId)
+  if err == nil || errors.Is(err, ErrNotFound) {
+    recentTokens.delUid(uid, clientId)
+  }
+  if errors.Is(err, ErrNotFound) {
     log.Info(fmt.Sprintf("DelClientIdForUid: uid(%s) donot have token for clientid(%s)", uid, clientId))
-    return
+    return err
+  }
+  if err != nil {
+    return err
   }
 
   log.Info(fmt.Sprintf("del the token(%s) of uid(%s) for clientid(%s)", token, uid, clientId))
-
-  _, err = db.Pipelined(func(pipeliner redis.Pipeliner) error {
-    pipeliner.Del(tokenKey(token))
-    pipeliner.HDel(uidKey(uid), clientId)
-    return nil
+  setTombstones(ctx, map[string]*Tombstone{
+    token: {Reason: ReasonSignedOut, Uid: uid, ClientId: clientId, At: time.Now()},
   })
-  must(logger, err)
+  Notify(ctx, &Event{Kind: EventDelClientId, Uid: uid, ClientId: clientId, Token: eventToken(token),
+    Reason: ReasonSignedOut})
+  return nil
 }
 
-func DelAllForUid(ctx context.Context, uid string) {
+func DelClientIdForUid(ctx context.Context, uid string, clientId string) {
   _, logger := log.WithCtx(ctx)
+  mustFound(logger, DelClientIdForUidWithErr(ctx, uid, clientId))
+}
+
+func DelAllForUidWithErr(ctx context.Context, uid string) error {
+  ctx, logger := log.WithCtx(ctx)
   logger.PushPrefix("token db")
 
-  db := rediscache.Get(confValue.Redis)
-  clients, err := db.HGetAll(uidKey(uid)).Result()
-  must(logger, err)
+  log.Info(fmt.Sprintf("del all tokens of uid(%s)", uid))
 
-  tokenKeys := make([]string, 0, len(clients))
-  for _, token := range clients {
-    tokenKeys = append(tokenKeys, tokenKey(token))
+  s := currentStore()
+  // 删除的 token 需要记录墓碑，见 tombstone.go
+  tombstones := make(map[string]*Tombstone)
+  if tombstoneTTL() > 0 {
+    tokens, _ := s.FindAll(ctx, uid)
+    for _, token := range tokens {
+      tombstones[token] = &Tombstone{Reason: ReasonSignedOut, Uid: uid, At: time.Now()}
+    }
   }
 
-  log.Info(fmt.Sprintf("del all tokens of uid(%s)", uid))
+  if err := s.DelAll(ctx, uid); err != nil {
+    return err
+  }
+  recentTokens.delUid(uid, "")
+  setTombstones(ctx, tombstones)
+  Notify(ctx, &Event{Kind: EventDelAll, Uid: uid, Reason: ReasonSignedOut})
+  return nil
+}
 
-  _, err = db.Pipelined(func(pipeliner redis.Pipeliner) error {
-    pipeliner.Del(tokenKeys...)
-    pipeliner.Del(uidKey(uid))
-    return nil
-  })
-  must(logger, err)
+func DelAllForUid(ctx context.Context, uid string) {
+  _, logger := log.WithCtx(ctx)
+  must(logger, DelAllForUidWithErr(ctx, uid))
 }
 
-func Find(ctx context.Context, uid string, clientId string) (db *DB, ok bool) {
+// FindWithErr 没有对应的 token 时返回 ErrNotFound
+func FindWithErr(ctx context.Context, uid string, clientId string) (*DB, error) {
   ctx, logger := log.WithCtx(ctx)
   logger.PushPrefix("token db")
 
-  rdb := rediscache.Get(confValue.Redis)
+  s := currentStore()
 
-  // 先淘汰，重试两次都失败，直接返回
-  if eviction(ctx, rdb, uidKey(uid)) && eviction(ctx, rdb, uidKey(uid)) {
-    logger.Error("Find: eviction twice error")
-    return nil, false
+  // 先淘汰
+  evicted, err := s.Evict(ctx, uid, limitOf(""))
+  if err != nil {
+    return nil, err
   }
+  onEvicted(ctx, uid, nil, evicted)
 
-  token, err := rdb.HGet(uidKey(uid), clientId).Result()
-  must(logger, err)
-
-  if err == redis.Nil {
+  token, err := s.Find(ctx, uid, clientId)
+  if errors.Is(err, ErrNotFound) {
     logger.Warning(fmt.Sprintf("not find token of uid(%s) for clientId(%s)", uid, clientId))
-    return nil, false
+  }
+  if err != nil {
+    return nil, err
   }
 
-  return New(ctx, token), true
+  return newWithKey(ctx, token), nil
 }
 
-func FindAll(ctx context.Context, uid string) []*DB {
+func Find(ctx context.Context, uid string, clientId string) (db *DB, ok bool) {
+  _, logger := log.WithCtx(ctx)
+  db, err := FindWithErr(ctx, uid, clientId)
+  return db, mustFound(logger, err)
+}
+
+func FindAllWithErr(ctx context.Context, uid string) ([]*DB, error) {
   ctx, logger := log.WithCtx(ctx)
   logger.PushPrefix("token db")
 
-  rdb := rediscache.Get(confValue.Redis)
+  s := currentStore()
 
-  // 先淘汰，重试两次都失败，直接返回
-  if eviction(ctx, rdb, uidKey(uid)) && eviction(ctx, rdb, uidKey(uid)) {
-    logger.Error("FindAll: eviction twice error")
-    return []*DB{}
+  // 先淘汰
+  evicted, err := s.Evict(ctx, uid, limitOf(""))
+  if err != nil {
+    return nil, err
   }
+  onEvicted(ctx, uid, nil, evicted)
 
-  clients, err := rdb.HGetAll(uidKey(uid)).Result()
-  must(logger, err)
+  tokens, err := s.FindAll(ctx, uid)
+  if err != nil {
+    return nil, err
+  }
 
-  ret := make([]*DB, 0, len(clients))
-  if len(clients) == 0 {
+  ret := make([]*DB, 0, len(tokens))
+  if len(tokens) == 0 {
     logger.Warning(fmt.Sprintf("not find any token of uid(%s)", uid))
-    return ret
+    return ret, nil
   }
 
-  for _, token := range clients {
-    ret = append(ret, New(ctx, token))
+  for _, token := range tokens {
+    ret = append(ret, newWithKey(ctx, token))
   }
 
+  return ret, nil
+}
+
+func FindAll(ctx context.Context, uid string) []*DB {
+  _, logger := log.WithCtx(ctx)
+  ret, err := FindAllWithErr(ctx, uid)
+  must(logger, err)
   return ret
 }
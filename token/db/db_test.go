@@ -0,0 +1,40 @@
+package db
+
+import (
+  "context"
+  "testing"
+  "time"
+)
+
+// useMemoryStore 每个测试使用新的 memory store，返回可以调整时间的 store，并在结束时恢复配置
+func useMemoryStore(t *testing.T) *memoryStore {
+  m := NewMemoryStore().(*memoryStore)
+  now := time.Now()
+  m.now = func() time.Time {
+    return now
+  }
+  SetStore(m)
+
+  saved := *confValue
+  t.Cleanup(func() {
+    *confValue = saved
+    SetEviction(nil)
+  })
+  return m
+}
+
+// advance 使 memory store 的时间前进 d
+func advance(m *memoryStore, d time.Duration) {
+  now := m.now().Add(d)
+  m.now = func() time.Time {
+    return now
+  }
+}
+
+func newToken(t *testing.T, token string, value Value) *DB {
+  d := New(context.Background(), token)
+  if err := d.OverWriteWithErr(&value); err != nil {
+    t.Fatalf("overwrite %s: %v", token, err)
+  }
+  return d
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+  "errors"
+  "sync"
+  "time"
+)
+
+/**
+ * 降级策略，存储不可用时:
+ *   1、熔断：连续 FailureThreshold 次 ErrStoreUnavailable 后，在 OpenMs 内直接返回 StoreUnavailable(ErrCircuitOpen)，
+ *      不再访问存储；OpenMs 之后只放行一个探测的请求，成功即恢复，失败则再次熔断，探测期间其他请求仍然熔断
+ *   2、本地缓存：最近 CacheSeconds 内验证过的 token(最多 CacheSize 个，见 lru.go)，在存储不可用时仍可以读取其 uid。
+ *      缓存只在本进程内失效，其他进程删除的 token 在缓存有效期内仍可能被读到
+ */
+
+var ErrCircuitOpen = errors.New("token db: circuit open")
+
+type breaker struct {
+  mu        sync.Mutex
+  failures  int64
+  openUntil time.Time
+  // 半开：openUntil 之后只放行一个探测的请求，其结果决定恢复还是再次熔断
+  probing    bool
+  probeStart time.Time
+}
+
+var storeBreaker = &breaker{}
+
+func openDuration() time.Duration {
+  return time.Duration(confValue.Degrade.OpenMs) * time.Millisecond
+}
+
+func (b *breaker) allow() bool {
+  if confValue.Degrade.FailureThreshold <= 0 {
+    return true
+  }
+
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  now := time.Now()
+  if b.openUntil.IsZero() {
+    return true
+  }
+  if now.Before(b.openUntil) {
+    return false
+  }
+  // 探测的请求一直没有结果时(比如没有超时)，openDuration 之后再放行一个
+  if b.probing && now.Sub(b.probeStart) < openDuration() {
+    return false
+  }
+  b.probing = true
+  b.probeStart = now
+  return true
+}
+
+func (b *breaker) record(err error) {
+  if confValue.Degrade.FailureThreshold <= 0 {
+    return
+  }
+
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if !errors.Is(err, ErrStoreUnavailable) {
+    b.failures = 0
+    b.openUntil = time.Time{}
+    b.probing = false
+    return
+  }
+
+  b.failures++
+  if b.probing || b.failures >= confValue.Degrade.FailureThreshold {
+    b.openUntil = time.Now().Add(openDuration())
+    b.probing = false
+  }
+}
+
+func (b *breaker) reset() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.failures = 0
+  b.openUntil = time.Time{}
+  b.probing = false
+}
+
+type validated struct {
+  uid      string
+  clientId string
+}
+
+// validatedCache token ---> validated，同时按 uid 索引，delUid 只需处理 uid 自己的 token
+type validatedCache struct {
+  mu     sync.Mutex
+  tokens *lruCache
+  // uid ---> {token}
+  uids map[string]map[string]struct{}
+}
+
+func newValidatedCache() *validatedCache {
+  c := &validatedCache{uids: make(map[string]map[string]struct{})}
+  c.tokens = newLRUCache(func() int64 {
+    return confValue.Degrade.CacheSize
+  }, cacheWindow)
+  c.tokens.onRemove = func(token string, value interface{}) {
+    uid := value.(validated).uid
+    delete(c.uids[uid], token)
+    if len(c.uids[uid]) == 0 {
+      delete(c.uids, uid)
+    }
+  }
+  return c
+}
+
+var recentTokens = newValidatedCache()
+
+func cacheWindow() time.Duration {
+  return time.Duration(confValue.Degrade.CacheSeconds) * time.Second
+}
+
+// clientId 未知时传 ""
+func (c *validatedCache) add(token, uid, clientId string) {
+  if cacheWindow() <= 0 {
+    return
+  }
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  // token 的 uid 不会改变，覆盖时不需要更新原来的索引
+  c.tokens.add(token, validated{uid: uid, clientId: clientId}, time.Now())
+  if _, ok := c.uids[uid]; !ok {
+    c.uids[uid] = make(map[string]struct{})
+  }
+  c.uids[uid][token] = struct{}{}
+}
+
+func (c *validatedCache) uid(token string) (uid string, ok bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  v, _, ok := c.tokens.get(token, time.Now())
+  if !ok {
+    return "", false
+  }
+  return v.(validated).uid, true
+}
+
+func (c *validatedCache) del(token string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.tokens.del(token)
+}
+
+// delUid clientId 为 "" 时删除 uid 的所有 token，否则只删除 clientId 的及 clientId 未知的
+func (c *validatedCache) delUid(uid string, clientId string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  for token := range c.uids[uid] {
+    v, _, ok := c.tokens.get(token, time.Now())
+    if ok && (clientId == "" || v.(validated).clientId == "" || v.(validated).clientId == clientId) {
+      c.tokens.del(token)
+    }
+  }
+}
+
+func (c *validatedCache) reset() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.tokens.reset()
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+func TestLRUCache(t *testing.T) {
+  var size int64 = 2
+  ttl := time.Minute
+  var removed []string
+  c := newLRUCache(func() int64 { return size }, func() time.Duration { return ttl })
+  c.onRemove = func(key string, value interface{}) {
+    removed = append(removed, key)
+  }
+
+  now := time.Now()
+  c.add("a", 1, now)
+  c.add("b", 2, now)
+  c.add("a", 3, now)
+  c.add("c", 4, now)
+  if _, _, ok := c.get("b", now); ok {
+    t.Error("b is not evicted")
+  }
+  if v, _, ok := c.get("a", now); !ok || v != 3 {
+    t.Errorf("a: %v, %v", v, ok)
+  }
+
+  if _, _, ok := c.get("c", now.Add(ttl)); ok {
+    t.Error("c is not expired")
+  }
+  if fmt.Sprint(removed) != "[b c]" {
+    t.Errorf("removed: %v", removed)
+  }
+
+  size = 0
+  if c.capacity() != defaultCacheSize {
+    t.Errorf("capacity: %d", c.capacity())
+  }
+  c.reset()
+  if c.len() != 0 || len(c.items) != 0 {
+    t.Errorf("len after reset: %d", c.len())
+  }
+}
+
+func TestValidatedCache(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Degrade.CacheSize = 3
+  confValue.Degrade.CacheSeconds = 60
+  c := newValidatedCache()
+
+  c.add("t1", "u1", "c1")
+  c.add("t2", "u1", "c2")
+  c.add("t3", "u1", "")
+  c.delUid("u1", "c1")
+  for token, ok := range map[string]bool{"t1": false, "t2": true, "t3": false} {
+    if _, got := c.uid(token); got != ok {
+      t.Errorf("%s: %v", token, got)
+    }
+  }
+
+  c.add("t4", "u2", "c1")
+  c.add("t5", "u2", "c2")
+  c.add("t6", "u2", "c3")
+  if _, ok := c.uid("t2"); ok {
+    t.Error("t2 is not evicted")
+  }
+  if _, ok := c.uids["u1"]; ok {
+    t.Error("the index of u1 is not removed")
+  }
+
+  c.delUid("u2", "")
+  if len(c.uids) != 0 || c.tokens.len() != 0 {
+    t.Errorf("after delUid: %v, %d", c.uids, c.tokens.len())
+  }
+}
+
+func TestBreakerProbe(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Degrade.FailureThreshold = 2
+  confValue.Degrade.OpenMs = 10
+  b := &breaker{}
+
+  b.record(ErrStoreUnavailable)
+  if !b.allow() {
+    t.Fatal("open before the threshold")
+  }
+  b.record(ErrStoreUnavailable)
+  if b.allow() {
+    t.Fatal("not open")
+  }
+
+  time.Sleep(openDuration())
+  if !b.allow() {
+    t.Fatal("no probe when half-open")
+  }
+  if b.allow() {
+    t.Fatal("more than one probe")
+  }
+  // 探测失败立即再次熔断
+  b.record(ErrStoreUnavailable)
+  if b.allow() {
+    t.Fatal("not open after the probe failed")
+  }
+
+  time.Sleep(openDuration())
+  if !b.allow() {
+    t.Fatal("no probe")
+  }
+  b.record(nil)
+  if !b.allow() || !b.allow() {
+    t.Fatal("not closed after the probe succeeded")
+  }
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+  "errors"
+  "fmt"
+)
+
+var (
+  // ErrNotFound token 或者 uid/clientId 对应的数据不存在
+  ErrNotFound = errors.New("token db: not found")
+
+  // ErrExpired token 的数据曾经存在，但已经过期
+  ErrExpired = errors.New("token db: expired")
+
+  // ErrStoreUnavailable 存储本身出错，比如 redis 连接失败、超时。可用 errors.Is 判断
+  ErrStoreUnavailable = errors.New("token db: store unavailable")
+)
+
+// storeUnavailableError 既满足 errors.Is(err, ErrStoreUnavailable)，也可以 errors.Is 到具体的原因，
+// 比如 context.DeadlineExceeded
+type storeUnavailableError struct {
+  cause error
+}
+
+func (e *storeUnavailableError) Error() string {
+  return fmt.Sprintf("%s: %v", ErrStoreUnavailable, e.cause)
+}
+
+func (e *storeUnavailableError) Is(target error) bool {
+  return target == ErrStoreUnavailable
+}
+
+func (e *storeUnavailableError) Unwrap() error {
+  return e.cause
+}
+
+// StoreUnavailable 供 Store 的实现者包装存储本身的错误
+func StoreUnavailable(cause error) error {
+  return &storeUnavailableError{cause: cause}
+}
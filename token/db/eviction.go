@@ -0,0 +1,299 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "sort"
+  "sync"
+  "time"
+)
+
+/**
+ * 淘汰策略：uid 的某一淘汰分组(见 policy.go)的设备数达到 Devices.Max 时，由 EvictionStrategy 选出淘汰的 token。
+ *
+ * 内置的策略：
+ *   lru：按 LatestTime 淘汰最早的，直到剩余不超过 Devices.Min 个
+ *   fifo：按 IssuedAt 淘汰最早登录的，直到剩余不超过 Devices.Min 个
+ *   reject：不淘汰，拒绝新的登录，返回 ErrTooManyDevices
+ *   sameType：与 lru 相同，但只淘汰与新登录的 ClientType 相同的 token
+ *
+ * 写入的 Value.Exclusive 不为空时，先撤销同一个 uid 在此互斥分组中其他 ClientId 的 token(比如只允许一部手机登录)，
+ * 这些 token 同样作为淘汰的 token 返回，且不再计入设备数。
+ *
+ * 淘汰与写入是同一个原子操作，redis 中在 Lua 脚本中执行，所以 redis 只支持内置的策略，
+ * 自定义的策略(SetEviction)需要 Store 直接调用 EvictionStrategy，比如 memory。
+ * 当前的 Store 不能执行的策略，SetEvictionWithErr 返回 ErrEvictionNotSupported，不会等到登录时才出错
+ */
+
+var (
+  // ErrTooManyDevices 设备数已达到限制，拒绝新的登录
+  ErrTooManyDevices = errors.New("token db: too many devices")
+
+  // ErrEvictionNotSupported 当前 Store 不支持此淘汰策略
+  ErrEvictionNotSupported = errors.New("token db: the eviction strategy is not supported by the store")
+)
+
+// 淘汰相关的脚本返回的状态
+const (
+  evictOk       = "ok"
+  evictRejected = "rejected"
+)
+
+const (
+  EvictLRU      = "lru"
+  EvictFIFO     = "fifo"
+  EvictReject   = "reject"
+  EvictSameType = "sameType"
+)
+
+// Device uid 的一个 token，不存在的 token 除 ClientId、Token 之外都是零值
+type Device struct {
+  ClientId   string
+  // 存储中使用的值
+  Token      string
+  ClientType string
+  Exclusive  string
+  LatestTime time.Time
+  IssuedAt   time.Time
+}
+
+type EvictionStrategy interface {
+  // Victims group 为同一淘汰分组中已有的 token，不包括 incoming 的 ClientId；d 为这一分组的设备数限制；
+  // incoming 为正在写入这一分组的 token，没有时为 nil。返回需要淘汰的 token，拒绝写入时返回 ErrTooManyDevices
+  Victims(group []Device, d Devices, incoming *Value) ([]Device, error)
+}
+
+// EvictionChecker 只能执行部分淘汰策略的 Store 实现此接口，比如 redis 只能执行内置的策略。
+// 没有实现此接口的 Store 视为可以执行所有的策略
+type EvictionChecker interface {
+  SupportsEviction(e EvictionStrategy) bool
+}
+
+func (t *timeoutStore) SupportsEviction(e EvictionStrategy) bool {
+  c, ok := t.Store.(EvictionChecker)
+  return !ok || c.SupportsEviction(e)
+}
+
+func supportsEviction(s Store, e EvictionStrategy) bool {
+  c, ok := s.(EvictionChecker)
+  return !ok || e == nil || c.SupportsEviction(e)
+}
+
+// scriptEviction 内置的策略，redis 的脚本中按 name 执行
+type scriptEviction interface {
+  name() string
+}
+
+type orderedEviction struct {
+  strategy string
+  less     func(a, b *Device) bool
+  // 只淘汰与 incoming 的 ClientType 相同的 token
+  sameType bool
+}
+
+func (e *orderedEviction) name() string {
+  return e.strategy
+}
+
+func (e *orderedEviction) Victims(group []Device, d Devices, incoming *Value) ([]Device, error) {
+  n := int64(len(group))
+  if incoming != nil {
+    n++
+  }
+  if n < d.Max {
+    return nil, nil
+  }
+
+  candidates := make([]Device, 0, len(group))
+  for _, device := range group {
+    if e.sameType && incoming != nil && device.ClientType != incoming.ClientType {
+      continue
+    }
+    candidates = append(candidates, device)
+  }
+  sort.Slice(candidates, func(i, j int) bool {
+    if e.less(&candidates[i], &candidates[j]) {
+      return true
+    }
+    if e.less(&candidates[j], &candidates[i]) {
+      return false
+    }
+    return candidates[i].ClientId < candidates[j].ClientId
+  })
+
+  victims := make([]Device, 0)
+  for _, device := range candidates {
+    if n <= d.Min {
+      break
+    }
+    victims = append(victims, device)
+    n--
+  }
+  return victims, nil
+}
+
+type rejectEviction struct{}
+
+func (rejectEviction) name() string {
+  return EvictReject
+}
+
+func (rejectEviction) Victims(group []Device, d Devices, incoming *Value) ([]Device, error) {
+  if incoming != nil && int64(len(group))+1 >= d.Max {
+    return nil, ErrTooManyDevices
+  }
+  return nil, nil
+}
+
+func byLatestTime(a, b *Device) bool {
+  return a.LatestTime.Before(b.LatestTime)
+}
+
+func byIssuedAt(a, b *Device) bool {
+  return a.IssuedAt.Before(b.IssuedAt)
+}
+
+// NewEviction 内置的淘汰策略，name 为 EvictLRU、EvictFIFO、EvictReject 或者 EvictSameType
+func NewEviction(name string) (EvictionStrategy, error) {
+  switch name {
+  case EvictLRU, "":
+    return &orderedEviction{strategy: EvictLRU, less: byLatestTime}, nil
+  case EvictFIFO:
+    return &orderedEviction{strategy: EvictFIFO, less: byIssuedAt}, nil
+  case EvictReject:
+    return rejectEviction{}, nil
+  case EvictSameType:
+    return &orderedEviction{strategy: EvictSameType, less: byLatestTime, sameType: true}, nil
+  }
+  return nil, fmt.Errorf("token db: unknown eviction(%s), must be one of %s, %s, %s, %s",
+    name, EvictLRU, EvictFIFO, EvictReject, EvictSameType)
+}
+
+var (
+  eviction   EvictionStrategy
+  evictionMu sync.Mutex
+)
+
+// SetEvictionWithErr 替换配置中的淘汰策略，应在使用 token 之前调用(需要替换 Store 时，先调用 SetStore)。
+// 当前的 Store 不能执行 e 时返回 ErrEvictionNotSupported；e 为 nil 时恢复为配置中的策略
+func SetEvictionWithErr(e EvictionStrategy) error {
+  if !supportsEviction(currentStore(), e) {
+    return ErrEvictionNotSupported
+  }
+
+  evictionMu.Lock()
+  defer evictionMu.Unlock()
+  eviction = e
+  return nil
+}
+
+func SetEviction(e EvictionStrategy) {
+  if err := SetEvictionWithErr(e); err != nil {
+    panic(err)
+  }
+}
+
+// customEviction SetEviction 设置的策略，没有设置时为 nil
+func customEviction() EvictionStrategy {
+  evictionMu.Lock()
+  defer evictionMu.Unlock()
+  return eviction
+}
+
+func currentEviction() EvictionStrategy {
+  evictionMu.Lock()
+  defer evictionMu.Unlock()
+
+  // 配置在 init 之后才读取
+  if eviction == nil {
+    e, err := NewEviction(confValue.Eviction)
+    if err != nil {
+      panic(err)
+    }
+    eviction = e
+  }
+  return eviction
+}
+
+// evictionGroup 按 Limit.devicesOf 分组后的 token
+type evictionGroup struct {
+  devices  []Device
+  limit    Devices
+  incoming bool
+}
+
+// evictionVictims 供 Store 的实现者使用：devices 为 uid 的所有 token(不包括 incoming 的 ClientId)，
+// 先选出与 incoming 在同一互斥分组中的 token，其余的按 limit 分组后由 limit.Eviction 选出需要淘汰的 token。
+// incoming 为 nil 时只淘汰超出限制的分组
+func evictionVictims(devices []Device, limit Limit, incoming *Value) ([]Device, error) {
+  victims := make([]Device, 0)
+  groups := make(map[string]*evictionGroup)
+  groupOf := func(clientType string) *evictionGroup {
+    name, d := limit.devicesOf(clientType)
+    g, ok := groups[name]
+    if !ok {
+      g = &evictionGroup{limit: d}
+      groups[name] = g
+    }
+    return g
+  }
+
+  for _, device := range devices {
+    if incoming != nil && incoming.Exclusive != "" && device.Exclusive == incoming.Exclusive {
+      victims = append(victims, device)
+      continue
+    }
+    g := groupOf(device.ClientType)
+    g.devices = append(g.devices, device)
+  }
+  if incoming != nil {
+    groupOf(incoming.ClientType).incoming = true
+  }
+
+  strategy := limit.Eviction
+  if strategy == nil {
+    strategy = &orderedEviction{strategy: EvictLRU, less: byLatestTime}
+  }
+
+  for _, g := range groups {
+    var in *Value
+    if g.incoming {
+      in = incoming
+    }
+    v, err := strategy.Victims(g.devices, g.limit, in)
+    if err != nil {
+      return nil, err
+    }
+    victims = append(victims, v...)
+  }
+  return victims, nil
+}
+
+// onEvicted 记录淘汰的 token，清除其降级缓存并通知 Observer。incoming 为正在写入的 token，没有时为 nil
+func onEvicted(ctx context.Context, uid string, incoming *Value, evicted []Device) []Device {
+  _, logger := log.WithCtx(ctx)
+  for _, device := range evicted {
+    logger.Info(fmt.Sprintf("evict token(%s) of [uid(%s), clientid(%s)]", device.Token, uid, device.ClientId))
+    recentTokens.delUid(uid, device.ClientId)
+  }
+  notifyEvicted(ctx, uid, incoming, evicted)
+  return evicted
+}
+
+// Evicted 最近一次 OverWrite 或者 SetOrUseOld 时淘汰的 token
+func (db *DB) Evicted() []Device {
+  return db.evicted
+}
+
+// evictionName redis 脚本中使用的策略名，自定义的策略返回 ErrEvictionNotSupported
+func evictionName(limit Limit) (string, error) {
+  if limit.Eviction == nil {
+    return EvictLRU, nil
+  }
+  if e, ok := limit.Eviction.(scriptEviction); ok {
+    return e.name(), nil
+  }
+  return "", ErrEvictionNotSupported
+}
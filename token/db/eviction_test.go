@@ -0,0 +1,135 @@
+package db
+
+import (
+  "errors"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+  "github.com/go-redis/redis"
+)
+
+// keepAll 不淘汰任何 token 的自定义策略
+type keepAll struct{}
+
+func (keepAll) Victims(group []Device, d Devices, incoming *Value) ([]Device, error) {
+  return nil, nil
+}
+
+func TestSetEvictionNotSupported(t *testing.T) {
+  useMemoryStore(t)
+  if err := SetEvictionWithErr(keepAll{}); err != nil {
+    t.Fatalf("memory: %v", err)
+  }
+
+  // redis 只能执行内置的策略，不访问 redis
+  func() {
+    defer func() {
+      if r := recover(); r == nil {
+        t.Error("set redis store with a custom eviction")
+      }
+    }()
+    SetStore(NewRedisStore(redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})))
+  }()
+
+  SetEviction(nil)
+  SetStore(NewRedisStore(redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})))
+  t.Cleanup(func() {
+    SetStore(NewMemoryStore())
+  })
+  if err := SetEvictionWithErr(keepAll{}); !errors.Is(err, ErrEvictionNotSupported) {
+    t.Errorf("redis: %v", err)
+  }
+  fifo, _ := NewEviction(EvictFIFO)
+  if err := SetEvictionWithErr(fifo); err != nil {
+    t.Errorf("redis builtin: %v", err)
+  }
+}
+
+// clientIds 排序后的 ClientId，用于比较淘汰的结果
+func clientIds(devices []Device) string {
+  ids := make([]string, 0, len(devices))
+  for _, d := range devices {
+    ids = append(ids, d.ClientId)
+  }
+  sort.Strings(ids)
+  return strings.Join(ids, ",")
+}
+
+func TestEvictionStrategies(t *testing.T) {
+  at := func(sec int64) time.Time {
+    return time.Unix(sec, 0)
+  }
+  group := []Device{
+    {ClientId: "a", ClientType: "phone", LatestTime: at(1), IssuedAt: at(3)},
+    {ClientId: "b", ClientType: "web", LatestTime: at(2), IssuedAt: at(1)},
+    {ClientId: "c", ClientType: "phone", LatestTime: at(3), IssuedAt: at(2)},
+  }
+  phone := &Value{ClientId: "d", ClientType: "phone"}
+  full := Devices{Min: 2, Max: 3}
+
+  tests := []struct {
+    strategy string
+    d        Devices
+    incoming *Value
+    victims  string
+    err      error
+  }{
+    {EvictLRU, full, phone, "a,b", nil},
+    {EvictFIFO, full, phone, "b,c", nil},
+    {EvictSameType, full, phone, "a,c", nil},
+    {EvictReject, full, phone, "", ErrTooManyDevices},
+    {EvictLRU, Devices{Min: 1, Max: 5}, phone, "", nil},
+    {EvictReject, Devices{Min: 1, Max: 5}, phone, "", nil},
+    // 没有写入时(Find、FindAll)，只淘汰超出限制的
+    {EvictLRU, full, nil, "a", nil},
+    {EvictFIFO, full, nil, "b", nil},
+    {EvictSameType, full, nil, "a", nil},
+    {EvictReject, full, nil, "", nil},
+  }
+  for i, test := range tests {
+    e, err := NewEviction(test.strategy)
+    if err != nil {
+      t.Fatal(err)
+    }
+    victims, err := e.Victims(group, test.d, test.incoming)
+    if !errors.Is(err, test.err) || clientIds(victims) != test.victims {
+      t.Errorf("%d %s: %s, %v", i, test.strategy, clientIds(victims), err)
+    }
+  }
+
+  if _, err := NewEviction("random"); err == nil {
+    t.Error("unknown eviction")
+  }
+}
+
+func TestEvictionVictimsGroups(t *testing.T) {
+  at := func(sec int64) time.Time {
+    return time.Unix(sec, 0)
+  }
+  devices := []Device{
+    {ClientId: "p1", ClientType: "phone", Exclusive: "mobile", LatestTime: at(1)},
+    {ClientId: "p2", ClientType: "phone", LatestTime: at(2)},
+    {ClientId: "w1", ClientType: "web", Exclusive: "mobile", LatestTime: at(3)},
+    {ClientId: "t1", ClientType: "tv", LatestTime: at(4)},
+  }
+  // tv 单独一组，其他类型共用 MinDevices、MaxDevices
+  limit := Limit{MinDevices: 1, MaxDevices: 3, Devices: map[string]Devices{"tv": {Min: 1, Max: 2}}}
+
+  tests := []struct {
+    name     string
+    incoming *Value
+    victims  string
+  }{
+    {"tv", &Value{ClientId: "t2", ClientType: "tv"}, "p1,p2,t1"},
+    {"exclusive", &Value{ClientId: "p3", ClientType: "phone", Exclusive: "mobile"}, "p1,w1"},
+    {"other exclusive", &Value{ClientId: "w2", ClientType: "web", Exclusive: "desktop"}, "p1,p2,w1"},
+    {"no incoming", nil, "p1,p2"},
+  }
+  for _, test := range tests {
+    victims, err := evictionVictims(devices, limit, test.incoming)
+    if err != nil || clientIds(victims) != test.victims {
+      t.Errorf("%s: %s, %v", test.name, clientIds(victims), err)
+    }
+  }
+}
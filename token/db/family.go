@@ -0,0 +1,133 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * refresh token 的轮换与重复使用的发现：
+ *
+ *   1、一次登录(NewPair)产生一个 family，其 id 即是第一个 refresh token 在存储中使用的值，
+ *      这个 family 的所有 refresh token 及 access token 的 Value.Family 都是此 id
+ *   2、与 uid 的索引相对应，存储记录 uid 的各个 ClientId 当前的 family：
+ *        familyKey = 'family:' + uid  (cluster 模式下与 uidKey 使用相同的 hash tag)
+ *        familyKey ---> {ClientId_1:family_1, ClientId_2:family_2, ...}
+ *      写入、删除、淘汰 ClientId 的 token 时，同时更新或者删除其 family，family 不是当前的 token 不再有效
+ *   3、每次换取 access token 时，refresh token 同时轮换为新的 token，旧的 token 标记为已轮换，
+ *      并只保留 refresh.reuseWindow(不超过其原有的有效期)，避免每次轮换都留下一个长期有效的 key
+ *   4、已轮换的 refresh token 在保留期间再次出现，说明 refresh token 已经泄露，撤销整个 family
+ *      (保留期之后再出现的只是不存在的 token)：
+ *      删除 ClientId 当前的 refresh token 及其 family，这个 family 的 access token 也随之失效
+ */
+
+var (
+  // ErrNotRefreshToken token 有效，但不是可以轮换的 refresh token
+  ErrNotRefreshToken = errors.New("token db: not a refresh token")
+
+  // ErrRefreshReused 已经轮换过的 refresh token 再次使用，其 family 已经撤销
+  ErrRefreshReused = errors.New("token db: refresh token reused, the family is revoked")
+)
+
+// Rotator 支持 refresh token 轮换的 Store 实现此接口
+type Rotator interface {
+  // Rotate 把 refresh token 轮换为 newToken，newToken 继承 token 的 Value，有效期为 limit.TTL，返回 newToken 的 Value。
+  // token 不存在、其 family 已经不是当前的或者 IssuedAt 不晚于 NotBefore(同时清除其数据)时返回 ErrNotFound，
+  // 不是 refresh token 时返回 ErrNotRefreshToken，
+  // token 已经轮换过时撤销其 family 并返回 ErrRefreshReused。整个操作必须是原子的
+  Rotate(ctx context.Context, token string, newToken string, limit Limit) (*Value, error)
+}
+
+var ErrRotateNotSupported = errors.New("token db: the store does not support rotating refresh token")
+
+func reuseWindow() time.Duration {
+  return time.Duration(confValue.Refresh.ReuseWindowMinutes) * time.Minute
+}
+
+// rotateScript 返回的状态
+const (
+  rotateNotFound   = "notfound"
+  rotateNotRefresh = "notrefresh"
+  rotateReused     = "reused"
+)
+
+func (t *timeoutStore) Rotate(ctx context.Context, token string, newToken string, limit Limit) (*Value, error) {
+  r, ok := t.Store.(Rotator)
+  if !ok {
+    return nil, ErrRotateNotSupported
+  }
+
+  var value *Value
+  err := do(ctx, writeTimeout(), func(ctx context.Context) (err error) {
+    value, err = r.Rotate(ctx, token, newToken, limit)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return value, nil
+}
+
+// RotateWithErr db 为 refresh token，轮换为 newToken，返回 newToken 的 DB
+func (db *DB) RotateWithErr(newToken string) (*DB, error) {
+  _, logger := log.WithCtx(db.ctx)
+
+  // 新的 refresh token 不能超过登录的最长时间，见 lifetime.go
+  l := limitOf("")
+  ttl, err := db.maxTTLWithErr()
+  if err == nil {
+    ttl, err = db.lifetimeTTL(ttl)
+  }
+  if err != nil {
+    return nil, err
+  }
+  l.TTL = ttl
+  l.ReuseWindow = reuseWindow()
+  l.NotBefore = globalNotBefore.get(db.ctx)
+
+  ret, now := New(db.ctx, newToken), time.Now()
+  value, err := db.store.(Rotator).Rotate(db.ctx, db.key, ret.key, l)
+  if errors.Is(err, ErrRefreshReused) {
+    logger.Error(fmt.Sprintf("the rotated refresh token(%s) is reused", db.key))
+    db.onReused()
+  }
+  if err != nil {
+    return nil, db.withTombstone(err)
+  }
+
+  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)] rotate token(%s)=>token(%s)", value.Uid,
+    value.ClientId, db.key, ret.key))
+
+  recentTokens.del(db.key)
+  Notify(db.ctx, &Event{Kind: EventRotated, Uid: value.Uid, ClientId: value.ClientId, Token: db.token})
+  db.value = nil
+  ret.value = value
+  ret.expiresAt = now.Add(l.TTL)
+  return ret, nil
+}
+
+// onReused family 已经撤销，清除其降级缓存并通知 Observer。已轮换的 refresh token 在保留期间仍然存在，
+// 可以读到其 uid 及 ClientId
+func (db *DB) onReused() {
+  value := db.value
+  if value == nil {
+    value, _ = db.loadValue()
+  }
+  if value == nil {
+    Notify(db.ctx, &Event{Kind: EventRefreshReused, Token: db.token})
+    return
+  }
+
+  recentTokens.delUid(value.Uid, value.ClientId)
+  Notify(db.ctx, &Event{Kind: EventRefreshReused, Uid: value.Uid, ClientId: value.ClientId, Token: db.token})
+}
+
+func (db *DB) Rotate(newToken string) *DB {
+  _, logger := log.WithCtx(db.ctx)
+  ret, err := db.RotateWithErr(newToken)
+  must(logger, err)
+  return ret
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestRotateReuse(t *testing.T) {
+  m := useMemoryStore(t)
+  confValue.Refresh.ReuseWindowMinutes = 10
+
+  r0 := newToken(t, "r0", Value{Uid: "u1", ClientId: "c1", RefreshOnly: true})
+  r1, err := r0.RotateWithErr("r1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = New(r0.ctx, "r0").RotateWithErr("r2"); !errors.Is(err, ErrRefreshReused) {
+    t.Fatalf("reuse: %v", err)
+  }
+  // family 已经撤销
+  if _, err = r1.RotateWithErr("r3"); !errors.Is(err, ErrNotFound) {
+    t.Fatalf("rotate after reuse: %v", err)
+  }
+
+  r0 = newToken(t, "r0", Value{Uid: "u1", ClientId: "c1", RefreshOnly: true})
+  if _, err = r0.RotateWithErr("r1"); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := m.tokens["r0"]; !ok {
+    t.Fatal("the rotated token is deleted in the reuse window")
+  }
+  advance(m, 11*time.Minute)
+  if _, err = New(r0.ctx, "r0").RotateWithErr("r2"); !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired) {
+    t.Fatalf("reuse after the window: %v", err)
+  }
+  if _, err = New(r0.ctx, "r1").RotateWithErr("r2"); err != nil {
+    t.Fatalf("rotate the current: %v", err)
+  }
+}
+
+func TestRotateWithoutReuseWindow(t *testing.T) {
+  m := useMemoryStore(t)
+  confValue.Refresh.ReuseWindowMinutes = 0
+
+  r0 := newToken(t, "r0", Value{Uid: "u1", ClientId: "c1", RefreshOnly: true})
+  if _, err := r0.RotateWithErr("r1"); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := m.tokens["r0"]; ok {
+    t.Fatal("the rotated token is kept")
+  }
+}
+
+func TestRotateExpiresAt(t *testing.T) {
+  useMemoryStore(t)
+  confValue.MaxTTL = 90
+  confValue.AbsoluteTTL = 1
+
+  issuedAt := time.Now().Add(-12 * time.Hour)
+  r0 := newToken(t, "r0", Value{Uid: "u1", ClientId: "c1", RefreshOnly: true, IssuedAt: issuedAt})
+  r1, err := r0.RotateWithErr("r1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // 不超过登录的最长时间
+  if d := r1.ExpiresAt().Sub(issuedAt.Add(24 * time.Hour)); d < -time.Second || d > time.Second {
+    t.Errorf("expires at %s, issued at %s", r1.ExpiresAt(), issuedAt)
+  }
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "strings"
+)
+
+/**
+ * 配置了 HashTokens.Secret 后，存储中(tokenKey 及 uid 的索引)只保存 token 的 HMAC-SHA256，不再保存 token 本身，
+ * 拿到存储数据的人也无法使用其中的 token。
+ *
+ * token 中最后一个 '.' 及之前的部分(比如 redis cluster 的 slot tag)保持明文，其余部分替换为
+ * hashedMark + hex(HMAC-SHA256(secret, token))。
+ *
+ * 因为存储中没有 token 本身:
+ *   1、Find/FindAll 得到的 DB，RealToken() 返回 ""，仍可以用于 Value、Del 等操作，但不能再返回给客户端，
+ *      token.ResumeFromUidClientIdWithErr 此时返回 ErrHashedToken
+ *   2、SetOrUseOld 无法返回旧的 token，所以与 OverWrite 相同，总是使用新的 token
+ *
+ * 迁移：先配置 Secret 并打开 AcceptRaw，新的 token 以 hash 保存，旧的 token 仍可以使用；
+ * 然后执行 MigrateToHashed 把旧的 token 转为 hash 保存，最后关闭 AcceptRaw
+ */
+
+const hashedMark = "h:"
+
+// ErrHashedToken 存储中只有 token 的 hash，无法得到 token 本身
+var ErrHashedToken = errors.New("token db: the token is stored as its hash")
+
+func hashEnabled() bool {
+  return confValue.HashTokens.Secret != ""
+}
+
+func splitTag(token string) (tag string, body string) {
+  i := strings.LastIndex(token, slotTagSeparator)
+  return token[:i+1], token[i+1:]
+}
+
+func isHashed(key string) bool {
+  _, body := splitTag(key)
+  return strings.HasPrefix(body, hashedMark)
+}
+
+func hashToken(token string) string {
+  tag, _ := splitTag(token)
+  mac := hmac.New(sha256.New, []byte(confValue.HashTokens.Secret))
+  mac.Write([]byte(token))
+  return tag + hashedMark + hex.EncodeToString(mac.Sum(nil))
+}
+
+// storageKey token 在存储中使用的值
+func storageKey(token string) string {
+  if !hashEnabled() {
+    return token
+  }
+  return hashToken(token)
+}
+
+// HashMigrator 支持把旧的 token 转为 hash 保存的 Store 实现此接口
+type HashMigrator interface {
+  // MigrateHash 把存储中所有没有 hash 的 token 替换为 hash(token)，包括不在 uid 索引中的 access token，
+  // 以及 access token 的 Value.Refresh，返回替换的 token 个数
+  MigrateHash(ctx context.Context, isHashed func(token string) bool, hash func(token string) string) (int64, error)
+}
+
+var ErrMigrateHashNotSupported = errors.New("token db: the store does not support hash migration")
+
+func (t *timeoutStore) MigrateHash(ctx context.Context, isHashed func(token string) bool,
+  hash func(token string) string) (int64, error) {
+
+  m, ok := t.Store.(HashMigrator)
+  if !ok {
+    return 0, ErrMigrateHashNotSupported
+  }
+
+  // 与 Reconcile 一样，不使用单个操作的超时
+  return m.MigrateHash(ctx, isHashed, hash)
+}
+
+// MigrateToHashed 把旧的 token 转为 hash 保存，可以重复执行
+func MigrateToHashed(ctx context.Context) (migrated int64, err error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db migrate hash")
+
+  if !hashEnabled() {
+    return 0, errors.New("token db: hashTokens.secret is not set")
+  }
+
+  m, ok := currentStore().(HashMigrator)
+  if !ok {
+    return 0, ErrMigrateHashNotSupported
+  }
+
+  migrated, err = m.MigrateHash(ctx, isHashed, hashToken)
+  if err != nil {
+    logger.Error(err)
+    return
+  }
+
+  logger.Info(fmt.Sprintf("migrated %d tokens", migrated))
+  return
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestMigrateHash(t *testing.T) {
+  useMemoryStore(t)
+  ctx := context.Background()
+
+  value := Value{Uid: "u1", ClientId: "c1"}
+  refresh := newToken(t, "r1", value)
+  New(ctx, "a1").SetAccess(refresh, value, time.Minute)
+
+  confValue.HashTokens.Secret = "secret"
+  migrated, err := MigrateToHashed(ctx)
+  if err != nil || migrated != 2 {
+    t.Fatalf("migrated(%d), %v", migrated, err)
+  }
+  if migrated, _ = MigrateToHashed(ctx); migrated != 0 {
+    t.Errorf("migrate again: %d", migrated)
+  }
+
+  // access token 仍然指向其 refresh token，不是孤儿
+  report, err := Reconcile(ctx)
+  if err != nil || report.OrphanTokens != 0 {
+    t.Fatalf("reconcile: %s, %v", report, err)
+  }
+
+  access := New(ctx, "a1")
+  v, err := access.ValueWithErr()
+  if err != nil {
+    t.Fatalf("access: %v", err)
+  }
+  if v.Refresh != hashToken("r1") {
+    t.Errorf("refresh of the access token: %s", v.Refresh)
+  }
+  if uid, err := New(ctx, "r1").UidWithErr(); err != nil || uid != "u1" {
+    t.Errorf("uid(%s), %v", uid, err)
+  }
+
+  found, ok := Find(ctx, "u1", "c1")
+  if !ok || found.RealToken() != "" {
+    t.Errorf("found(%v): %s", ok, found.RealToken())
+  }
+}
+
+func TestAcceptRawRejectsHashedToken(t *testing.T) {
+  useMemoryStore(t)
+  ctx := context.Background()
+
+  newToken(t, "raw", Value{Uid: "u2", ClientId: "c1"})
+  confValue.HashTokens.Secret = "secret"
+  confValue.HashTokens.AcceptRaw = true
+  newToken(t, "t1", Value{Uid: "u1", ClientId: "c1"})
+  if uid, err := New(ctx, "t1").UidWithErr(); err != nil || uid != "u1" {
+    t.Fatalf("uid(%s), %v", uid, err)
+  }
+  if uid, err := New(ctx, "raw").UidWithErr(); err != nil || uid != "u2" {
+    t.Fatalf("raw: uid(%s), %v", uid, err)
+  }
+
+  // 存储中的值不能作为 token 使用
+  if uid, err := New(ctx, hashToken("t1")).UidWithErr(); !errors.Is(err, ErrNotFound) {
+    t.Errorf("stored value as token: uid(%s), %v", uid, err)
+  }
+  if _, err := New(ctx, hashToken("t1")).ValueWithErr(); !errors.Is(err, ErrNotFound) {
+    t.Errorf("value of the stored value: %v", err)
+  }
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+  "time"
+)
+
+/**
+ * token 的两个有效期：
+ *   MaxTTL：空闲的时间，写入及每次刷新 TTL 时，token 的有效期延长到 MaxTTL
+ *   AbsoluteTTL：登录的最长时间，从 Value.IssuedAt 开始计算，无论是否刷新过 TTL，之后都必须重新登录
+ *
+ * 刷新 TTL 时不会超过 AbsoluteTTL；验证时(Uid)同时检查 IssuedAt，没有 IssuedAt 的是之前写入的 token，只受 MaxTTL 限制
+ */
+
+func absoluteTTL() time.Duration {
+  return time.Duration(confValue.AbsoluteTTL) * 24 * time.Hour
+}
+
+// minIssuedAt IssuedAt 早于此时间的 token 已经过期，没有配置 AbsoluteTTL 时返回零值
+func minIssuedAt(now time.Time) time.Time {
+  if absoluteTTL() <= 0 {
+    return time.Time{}
+  }
+  return now.Add(-absoluteTTL())
+}
+
+// capTTL 使 token 不会在 AbsoluteTTL 之后仍然有效，返回值 <= 0 表示已经过期
+func capTTL(ttl time.Duration, value *Value, now time.Time) time.Duration {
+  if absoluteTTL() <= 0 || value.IssuedAt.IsZero() {
+    return ttl
+  }
+
+  if remain := value.IssuedAt.Add(absoluteTTL()).Sub(now); remain < ttl {
+    return remain
+  }
+  return ttl
+}
+
+// lifetimeTTL 刷新 TTL 时使用的 ttl，配置了 AbsoluteTTL 时需要读取 Value.IssuedAt，已经过期时返回 ErrExpired
+func (db *DB) lifetimeTTL(ttl time.Duration) (time.Duration, error) {
+  if absoluteTTL() <= 0 {
+    return ttl, nil
+  }
+
+  value, err := db.ValueWithErr()
+  if err != nil {
+    return 0, err
+  }
+
+  if ttl = capTTL(ttl, value, time.Now()); ttl <= 0 {
+    return 0, ErrExpired
+  }
+  return ttl, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+  "container/list"
+  "time"
+)
+
+/**
+ * lruCache 有容量上限及有效期的本地缓存，降级缓存(degrade.go)及滑动过期(sliding.go)共用。
+ *
+ * 每次 add 都把 key 移到最前面并更新其时间，所以链表同时按时间排序：满了或者过期时都从最后面删除，
+ * 所有操作都是 O(1)。lruCache 本身不加锁，调用者需持有锁
+ */
+
+// defaultCacheSize 配置的 cacheSize <= 0 时使用
+const defaultCacheSize = 100000
+
+type lruEntry struct {
+  key   string
+  value interface{}
+  at    time.Time
+}
+
+type lruCache struct {
+  list  *list.List
+  items map[string]*list.Element
+  // 容量及有效期在每次使用时读取，配置在 init 之后才读取
+  size func() int64
+  ttl  func() time.Duration
+  // 删除 key 时调用(包括满了、过期、del 及 reset)，可以为 nil
+  onRemove func(key string, value interface{})
+}
+
+func newLRUCache(size func() int64, ttl func() time.Duration) *lruCache {
+  return &lruCache{list: list.New(), items: make(map[string]*list.Element), size: size, ttl: ttl}
+}
+
+func (c *lruCache) capacity() int64 {
+  if size := c.size(); size > 0 {
+    return size
+  }
+  return defaultCacheSize
+}
+
+func (c *lruCache) add(key string, value interface{}, now time.Time) {
+  if e, ok := c.items[key]; ok {
+    entry := e.Value.(*lruEntry)
+    entry.value, entry.at = value, now
+    c.list.MoveToFront(e)
+  } else {
+    c.items[key] = c.list.PushFront(&lruEntry{key: key, value: value, at: now})
+  }
+
+  for int64(c.list.Len()) > c.capacity() {
+    c.remove(c.list.Back())
+  }
+  // 顺便清除最后面已经过期的
+  for e := c.list.Back(); e != nil && c.expired(e, now); e = c.list.Back() {
+    c.remove(e)
+  }
+}
+
+// get 过期的 key 视为不存在，并删除
+func (c *lruCache) get(key string, now time.Time) (value interface{}, at time.Time, ok bool) {
+  e, ok := c.items[key]
+  if !ok {
+    return nil, time.Time{}, false
+  }
+  if c.expired(e, now) {
+    c.remove(e)
+    return nil, time.Time{}, false
+  }
+
+  entry := e.Value.(*lruEntry)
+  return entry.value, entry.at, true
+}
+
+func (c *lruCache) del(key string) {
+  if e, ok := c.items[key]; ok {
+    c.remove(e)
+  }
+}
+
+func (c *lruCache) reset() {
+  for e := c.list.Back(); e != nil; e = c.list.Back() {
+    c.remove(e)
+  }
+}
+
+func (c *lruCache) len() int {
+  return c.list.Len()
+}
+
+func (c *lruCache) expired(e *list.Element, now time.Time) bool {
+  return now.Sub(e.Value.(*lruEntry).at) >= c.ttl()
+}
+
+func (c *lruCache) remove(e *list.Element) {
+  entry := e.Value.(*lruEntry)
+  c.list.Remove(e)
+  delete(c.items, entry.key)
+  if c.onRemove != nil {
+    c.onRemove(entry.key, entry.value)
+  }
+}
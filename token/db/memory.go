@@ -0,0 +1,606 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "sync"
+  "time"
+)
+
+/**
+ * 进程内的存储，与 redis 存储的语义相同，用于单元测试及单节点部署。
+ * 过期的 token 在访问时才会清除
+ */
+
+type memoryItem struct {
+  value    Value
+  expireAt time.Time
+  // 已经轮换过的 refresh token，见 family.go
+  rotated bool
+}
+
+type memoryStore struct {
+  mu     sync.Mutex
+  tokens map[string]*memoryItem
+  // uid ---> {ClientId: token}
+  uids map[string]map[string]string
+  // uid ---> {ClientId: family}
+  families map[string]map[string]string
+  // id ---> 过期时间
+  revoked map[string]time.Time
+  // token ---> 墓碑，见 tombstone.go
+  tombstones map[string]memoryTombstone
+  // uid ---> NotBefore，全局的 uid 为 ""，见 notbefore.go
+  notBefore map[string]memoryNotBefore
+  now       func() time.Time
+}
+
+func NewMemoryStore() Store {
+  return &memoryStore{
+    tokens:     make(map[string]*memoryItem),
+    uids:       make(map[string]map[string]string),
+    families:   make(map[string]map[string]string),
+    revoked:    make(map[string]time.Time),
+    tombstones: make(map[string]memoryTombstone),
+    notBefore:  make(map[string]memoryNotBefore),
+    now:        time.Now,
+  }
+}
+
+// 调用者需持有锁。过期的 token 返回 ErrExpired，并清除其数据
+func (m *memoryStore) get(token string) (item *memoryItem, err error) {
+  item, ok := m.tokens[token]
+  if !ok {
+    return nil, ErrNotFound
+  }
+
+  if !m.now().Before(item.expireAt) {
+    delete(m.tokens, token)
+    return nil, ErrExpired
+  }
+
+  return item, nil
+}
+
+func (m *memoryStore) clients(uid string) map[string]string {
+  c, ok := m.uids[uid]
+  if !ok {
+    c = make(map[string]string)
+    m.uids[uid] = c
+  }
+  return c
+}
+
+// delClient 同时删除 clientId 的 family
+func (m *memoryStore) delClient(uid string, clientId string) {
+  m.setFamily(uid, clientId, "")
+
+  c, ok := m.uids[uid]
+  if !ok {
+    return
+  }
+  delete(c, clientId)
+  if len(c) == 0 {
+    delete(m.uids, uid)
+  }
+}
+
+// setFamily family 为 "" 时删除
+func (m *memoryStore) setFamily(uid string, clientId string, family string) {
+  f, ok := m.families[uid]
+  if !ok && family == "" {
+    return
+  }
+  if !ok {
+    f = make(map[string]string)
+    m.families[uid] = f
+  }
+
+  if family == "" {
+    delete(f, clientId)
+  } else {
+    f[clientId] = family
+  }
+  if len(f) == 0 {
+    delete(m.families, uid)
+  }
+}
+
+func (m *memoryStore) Value(ctx context.Context, token string) (*Value, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  item, err := m.get(token)
+  if err != nil {
+    return nil, err
+  }
+
+  v := item.value
+  return &v, nil
+}
+
+func (m *memoryStore) Uid(ctx context.Context, token string, minIssuedAt time.Time,
+  notBefore time.Time) (uid string, err error) {
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  item, err := m.get(token)
+  if err == nil && !item.value.IssuedAt.IsZero() && item.value.IssuedAt.Before(minIssuedAt) {
+    err = ErrExpired
+  }
+  if err == nil && !validSince(item.value.IssuedAt, laterTime(notBefore, m.notBeforeOf(item.value.Uid))) {
+    err = ErrExpired
+  }
+  if err == nil && (item.rotated || item.value.RefreshOnly) {
+    // refresh token 只能用于换取 access token；保留其数据，已经轮换过的用于发现重复使用
+    return "", ErrNotFound
+  }
+  if err == nil && item.value.Uid != "" && (item.value.Family == "" ||
+    m.families[item.value.Uid][item.value.ClientId] == item.value.Family) {
+    return item.value.Uid, nil
+  }
+  if err == nil {
+    err = ErrNotFound
+  }
+
+  _, logger := log.WithCtx(ctx)
+  logger.Warning(fmt.Sprintf("have no token(%s) or the uid not exist", token))
+  delete(m.tokens, token)
+  return "", err
+}
+
+func (m *memoryStore) Exists(ctx context.Context, token string) (bool, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  _, err := m.get(token)
+  return err == nil, nil
+}
+
+// TTL 与 redis 一致，不存在时返回 -2s
+func (m *memoryStore) TTL(ctx context.Context, token string) (time.Duration, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  item, err := m.get(token)
+  if err != nil {
+    return -2 * time.Second, nil
+  }
+
+  return item.expireAt.Sub(m.now()), nil
+}
+
+func (m *memoryStore) Expire(ctx context.Context, token string, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if item, err := m.get(token); err == nil {
+    item.expireAt = m.now().Add(ttl)
+  }
+  return nil
+}
+
+func (m *memoryStore) ExpireAndSetLatestTime(ctx context.Context, token string, ttl time.Duration,
+  latestTime time.Time) error {
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if item, err := m.get(token); err == nil {
+    item.expireAt = m.now().Add(ttl)
+    item.value.LatestTime = latestTime
+  }
+  return nil
+}
+
+func (m *memoryStore) OverWrite(ctx context.Context, token string, value *Value, limit Limit) ([]Device, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  evicted, err := m.evict(value.Uid, limit, value)
+  if err != nil {
+    return nil, err
+  }
+
+  c := m.clients(value.Uid)
+  if old, ok := c[value.ClientId]; ok {
+    delete(m.tokens, old)
+  }
+
+  c[value.ClientId] = token
+  m.tokens[token] = &memoryItem{value: *value, expireAt: m.now().Add(limit.TTL)}
+  m.setFamily(value.Uid, value.ClientId, value.Family)
+
+  return evicted, nil
+}
+
+// lifetime 使用旧 token 时的 ttl，不超过登录的最长时间，返回值 <= 0 表示已经超过
+func lifetime(value *Value, limit Limit) time.Duration {
+  if limit.MinIssuedAt.IsZero() || value.IssuedAt.IsZero() {
+    return limit.TTL
+  }
+  if remain := value.IssuedAt.Sub(limit.MinIssuedAt); remain < limit.TTL {
+    return remain
+  }
+  return limit.TTL
+}
+
+func (m *memoryStore) SetOrUseOld(ctx context.Context, token string, value *Value,
+  limit Limit) (realToken string, evicted []Device, err error) {
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if evicted, err = m.evict(value.Uid, limit, value); err != nil {
+    return "", nil, err
+  }
+
+  c := m.clients(value.Uid)
+  old, ok := c[value.ClientId]
+  ttl := limit.TTL
+  if ok {
+    item, err := m.get(old)
+    if err == nil && item.value.Uid != "" {
+      ttl = lifetime(&item.value, limit)
+      if !validSince(item.value.IssuedAt, laterTime(limit.NotBefore, m.notBeforeOf(value.Uid))) {
+        ttl = 0
+      }
+    }
+    if err != nil || item.value.Uid == "" || ttl <= 0 {
+      // 旧值已经过期、超过登录的最长时间或者已经被 NotBefore 撤销，不再使用
+      delete(m.tokens, old)
+      ok = false
+    }
+  }
+  if !ok {
+    c[value.ClientId] = token
+    m.tokens[token] = &memoryItem{value: *value, expireAt: m.now().Add(limit.TTL)}
+    m.setFamily(value.Uid, value.ClientId, value.Family)
+    return token, evicted, nil
+  }
+
+  item := m.tokens[old]
+  item.value.LatestTime = value.LatestTime
+  item.value.Exclusive = value.Exclusive
+  item.expireAt = m.now().Add(ttl)
+
+  return old, evicted, nil
+}
+
+func (m *memoryStore) SetAccess(ctx context.Context, token string, value *Value, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.tokens[token] = &memoryItem{value: *value, expireAt: m.now().Add(ttl)}
+  return nil
+}
+
+func (m *memoryStore) Del(ctx context.Context, token string, value *Value) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  delete(m.tokens, token)
+  m.delClient(value.Uid, value.ClientId)
+  return nil
+}
+
+func (m *memoryStore) DelClientId(ctx context.Context, uid string, clientId string) (token string, err error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  token, ok := m.uids[uid][clientId]
+  if !ok {
+    return "", ErrNotFound
+  }
+
+  delete(m.tokens, token)
+  m.delClient(uid, clientId)
+  return token, nil
+}
+
+func (m *memoryStore) DelAll(ctx context.Context, uid string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  for _, token := range m.uids[uid] {
+    delete(m.tokens, token)
+  }
+  delete(m.uids, uid)
+  delete(m.families, uid)
+  return nil
+}
+
+func (m *memoryStore) Find(ctx context.Context, uid string, clientId string) (token string, err error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  token, ok := m.uids[uid][clientId]
+  if !ok {
+    return "", ErrNotFound
+  }
+  return token, nil
+}
+
+func (m *memoryStore) FindAll(ctx context.Context, uid string) (tokens []string, err error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  c := m.uids[uid]
+  tokens = make([]string, 0, len(c))
+  for _, token := range c {
+    tokens = append(tokens, token)
+  }
+  return tokens, nil
+}
+
+func (m *memoryStore) Evict(ctx context.Context, uid string, limit Limit) ([]Device, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  return m.evict(uid, limit, nil)
+}
+
+// 调用者需持有锁，按 ClientType 分组，由 limit.Eviction 选出淘汰的 token，见 eviction.go。
+// incoming 为正在写入的 token，其 ClientId 原有的 token 不参与淘汰
+func (m *memoryStore) evict(uid string, limit Limit, incoming *Value) ([]Device, error) {
+  devices := make([]Device, 0, len(m.uids[uid]))
+  for client, token := range m.uids[uid] {
+    if incoming != nil && client == incoming.ClientId {
+      continue
+    }
+    device := Device{ClientId: client, Token: token}
+    if item, err := m.get(token); err == nil {
+      device.ClientType = item.value.ClientType
+      device.Exclusive = item.value.Exclusive
+      device.LatestTime = item.value.LatestTime
+      device.IssuedAt = item.value.IssuedAt
+    }
+    devices = append(devices, device)
+  }
+
+  victims, err := evictionVictims(devices, limit, incoming)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, device := range victims {
+    delete(m.tokens, device.Token)
+    m.delClient(uid, device.ClientId)
+  }
+  return victims, nil
+}
+
+func (m *memoryStore) Reconcile(ctx context.Context) (report ReconcileReport, err error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  for uid, c := range m.uids {
+    report.ScannedUids++
+    for client, token := range c {
+      if _, err := m.get(token); err != nil {
+        m.delClient(uid, client)
+        report.DanglingRefs++
+      }
+    }
+  }
+
+  for uid, f := range m.families {
+    for client := range f {
+      if _, ok := m.uids[uid][client]; !ok {
+        m.setFamily(uid, client, "")
+        report.DanglingRefs++
+      }
+    }
+  }
+
+  for token, item := range m.tokens {
+    report.ScannedTokens++
+    if _, err := m.get(token); err != nil {
+      // 过期的 token 由 get 清除，不计为孤儿
+      continue
+    }
+    // 有 family 的 token 以 family 为准；access token 的 refresh token 不在 uid 的索引中时，也是孤儿
+    v := &item.value
+    ref := token
+    if v.Refresh != "" {
+      ref = v.Refresh
+    }
+    current := m.uids[v.Uid][v.ClientId] == ref
+    if v.Family != "" {
+      current = m.families[v.Uid][v.ClientId] == v.Family
+    }
+    if v.Uid == "" || !current {
+      delete(m.tokens, token)
+      report.OrphanTokens++
+    }
+  }
+
+  for id, expireAt := range m.revoked {
+    if !m.now().Before(expireAt) {
+      delete(m.revoked, id)
+    }
+  }
+
+  for token, t := range m.tombstones {
+    if !m.now().Before(t.expireAt) {
+      delete(m.tombstones, token)
+    }
+  }
+
+  for uid := range m.notBefore {
+    m.notBeforeOf(uid)
+  }
+
+  return report, nil
+}
+
+func (m *memoryStore) MigrateHash(ctx context.Context, isHashed func(token string) bool,
+  hash func(token string) string) (migrated int64, err error) {
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  for _, c := range m.uids {
+    for client, token := range c {
+      if isHashed(token) {
+        continue
+      }
+      if item, ok := m.tokens[token]; ok {
+        delete(m.tokens, token)
+        m.tokens[hash(token)] = item
+      }
+      c[client] = hash(token)
+      migrated++
+    }
+  }
+
+  // access token 不在 uid 的索引中，其 Value.Refresh 也需要指向 hash 之后的 refresh token
+  for token, item := range m.tokens {
+    if ref := item.value.Refresh; ref != "" && !isHashed(ref) {
+      item.value.Refresh = hash(ref)
+    }
+    if !isHashed(token) {
+      delete(m.tokens, token)
+      m.tokens[hash(token)] = item
+      migrated++
+    }
+  }
+
+  return migrated, nil
+}
+
+func (m *memoryStore) Rotate(ctx context.Context, token string, newToken string, limit Limit) (*Value, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  item, err := m.get(token)
+  if err != nil {
+    return nil, err
+  }
+  v := &item.value
+  if !v.RefreshOnly || v.Family == "" {
+    return nil, ErrNotRefreshToken
+  }
+  // family 已经撤销或者被新的登录替换
+  if m.families[v.Uid][v.ClientId] != v.Family {
+    return nil, ErrNotFound
+  }
+  if !validSince(v.IssuedAt, laterTime(limit.NotBefore, m.notBeforeOf(v.Uid))) {
+    delete(m.tokens, token)
+    return nil, ErrNotFound
+  }
+
+  current, ok := m.uids[v.Uid][v.ClientId]
+  if item.rotated || current != token {
+    // 重复使用，撤销整个 family
+    if ok {
+      delete(m.tokens, current)
+    }
+    m.delClient(v.Uid, v.ClientId)
+    return nil, ErrRefreshReused
+  }
+
+  item.rotated = true
+  if limit.ReuseWindow <= 0 {
+    delete(m.tokens, token)
+  } else if expireAt := m.now().Add(limit.ReuseWindow); expireAt.Before(item.expireAt) {
+    item.expireAt = expireAt
+  }
+  m.tokens[newToken] = &memoryItem{value: *v, expireAt: m.now().Add(limit.TTL)}
+  m.uids[v.Uid][v.ClientId] = newToken
+
+  ret := *v
+  return &ret, nil
+}
+
+func (m *memoryStore) Revoke(ctx context.Context, id string, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.revoked[id] = m.now().Add(ttl)
+  return nil
+}
+
+func (m *memoryStore) IsRevoked(ctx context.Context, id string) (bool, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  expireAt, ok := m.revoked[id]
+  if ok && !m.now().Before(expireAt) {
+    delete(m.revoked, id)
+    return false, nil
+  }
+  return ok, nil
+}
+
+type memoryTombstone struct {
+  tombstone Tombstone
+  expireAt  time.Time
+}
+
+func (m *memoryStore) SetTombstones(ctx context.Context, tombstones map[string]*Tombstone, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  for token, t := range tombstones {
+    m.tombstones[token] = memoryTombstone{tombstone: *t, expireAt: m.now().Add(ttl)}
+  }
+  return nil
+}
+
+func (m *memoryStore) Tombstone(ctx context.Context, token string) (*Tombstone, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  t, ok := m.tombstones[token]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  if !m.now().Before(t.expireAt) {
+    delete(m.tombstones, token)
+    return nil, ErrNotFound
+  }
+
+  ret := t.tombstone
+  return &ret, nil
+}
+
+type memoryNotBefore struct {
+  at time.Time
+  // 零值：不过期
+  expireAt time.Time
+}
+
+// 调用者需持有锁。没有或者已经过期时返回零值，并清除过期的数据
+func (m *memoryStore) notBeforeOf(uid string) time.Time {
+  n, ok := m.notBefore[uid]
+  if !ok {
+    return time.Time{}
+  }
+  if !n.expireAt.IsZero() && !m.now().Before(n.expireAt) {
+    delete(m.notBefore, uid)
+    return time.Time{}
+  }
+  return n.at
+}
+
+func (m *memoryStore) SetNotBefore(ctx context.Context, uid string, t time.Time, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  n := memoryNotBefore{at: t}
+  if ttl > 0 {
+    n.expireAt = m.now().Add(ttl)
+  }
+  m.notBefore[uid] = n
+  return nil
+}
+
+func (m *memoryStore) NotBefore(ctx context.Context, uid string) (time.Time, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  return m.notBeforeOf(uid), nil
+}
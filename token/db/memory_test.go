@@ -0,0 +1,102 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestMemoryStoreLifecycle(t *testing.T) {
+  m := useMemoryStore(t)
+  confValue.MaxTTL = 1
+  ctx := context.Background()
+
+  d := newToken(t, "t1", Value{Uid: "u1", ClientId: "c1", Session: "s1"})
+  if uid, err := New(ctx, "t1").UidWithErr(); err != nil || uid != "u1" {
+    t.Fatalf("uid: %s, %v", uid, err)
+  }
+  if ttl := d.TTL(); ttl != 24*time.Hour {
+    t.Errorf("ttl: %v", ttl)
+  }
+
+  // 刷新之后从现在开始重新计算 TTL
+  advance(m, 23*time.Hour)
+  d.RefreshTTL()
+  advance(m, 23*time.Hour)
+  if session, err := New(ctx, "t1").SessionWithErr(); err != nil || session != "s1" {
+    t.Fatalf("session after refresh: %s, %v", session, err)
+  }
+  advance(m, 2*time.Hour)
+  if _, err := New(ctx, "t1").UidWithErr(); !errors.Is(err, ErrExpired) {
+    t.Fatalf("expired: %v", err)
+  }
+
+  // SetOrUseOld 复用同一个 ClientId 原有的 token
+  d = New(ctx, "t2")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c2"})
+  if d.RealToken() != "t2" {
+    t.Fatalf("set: %s", d.RealToken())
+  }
+  d = New(ctx, "t3")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c2"})
+  if d.RealToken() != "t2" {
+    t.Fatalf("use old: %s", d.RealToken())
+  }
+
+  newToken(t, "t4", Value{Uid: "u1", ClientId: "c3"})
+  if found, ok := Find(ctx, "u1", "c3"); !ok || found.RealToken() != "t4" {
+    t.Fatalf("find: %v", ok)
+  }
+  if all := FindAll(ctx, "u1"); len(all) != 3 {
+    t.Fatalf("find all: %d", len(all))
+  }
+
+  New(ctx, "t4").Del()
+  if _, ok := Find(ctx, "u1", "c3"); ok {
+    t.Error("find after del")
+  }
+  DelClientIdForUid(ctx, "u1", "c2")
+  if ok := New(ctx, "t2").IsValidToken(); ok {
+    t.Error("valid after DelClientIdForUid")
+  }
+  DelAllForUid(ctx, "u1")
+  if all := FindAll(ctx, "u1"); len(all) != 0 {
+    t.Errorf("find all after DelAllForUid: %d", len(all))
+  }
+}
+
+func TestMemoryStoreAllowDevices(t *testing.T) {
+  useMemoryStore(t)
+  confValue.AllowDevices.Min = 2
+  confValue.AllowDevices.Max = 3
+  ctx := context.Background()
+
+  now := time.Now()
+  newToken(t, "t1", Value{Uid: "u1", ClientId: "c1", LatestTime: now.Add(2 * time.Second)})
+  newToken(t, "t2", Value{Uid: "u1", ClientId: "c2", LatestTime: now.Add(time.Second)})
+  d := newToken(t, "t3", Value{Uid: "u1", ClientId: "c3", LatestTime: now.Add(3 * time.Second)})
+
+  // 达到 Max 时按 LatestTime 淘汰到 Min 个
+  if evicted := d.Evicted(); clientIds(evicted) != "c2" || evicted[0].Token != "t2" {
+    t.Fatalf("evicted: %+v", evicted)
+  }
+  if New(ctx, "t2").IsValidToken() {
+    t.Error("t2 is valid")
+  }
+  if all := FindAll(ctx, "u1"); len(all) != 2 {
+    t.Errorf("find all: %d", len(all))
+  }
+
+  // 同一个 ClientId 覆盖时不计入设备数
+  d = newToken(t, "t4", Value{Uid: "u1", ClientId: "c3", LatestTime: now})
+  if evicted := d.Evicted(); len(evicted) != 0 {
+    t.Errorf("evicted by overwrite: %+v", evicted)
+  }
+
+  confValue.Eviction = EvictReject
+  SetEviction(nil)
+  if err := New(ctx, "t5").OverWriteWithErr(&Value{Uid: "u1", ClientId: "c5"}); !errors.Is(err, ErrTooManyDevices) {
+    t.Errorf("reject: %v", err)
+  }
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "sync"
+  "time"
+)
+
+/**
+ * NotBefore(not valid before)：Value.IssuedAt 早于 uid 的或者全局的 NotBefore 的 token 都无效，比如修改密码或者安全事件之后，
+ * 只需写入一个值，不需要遍历 uid 的所有 token。
+ * 签名的 token(token 包)验证时总是以 Claims.IssuedAtMs 检查全局的 NotBefore(GlobalNotBefore，进程中缓存)；
+ * uid 的 NotBefore 需要读取存储，只在配置了 CheckRevocation 时检查，见 token/stateless.go。
+ *
+ * IssuedAt 与 NotBefore 都精确到毫秒(之前写入的为秒)，IssuedAt 不晚于 NotBefore 的 token 都无效(包括同一毫秒签发的)。
+ * 本进程中与设置的 NotBefore 同一毫秒签发的 token，IssuedAt 推后到 NotBefore 之后，之后设置的 NotBefore 也不早于
+ * 推后的 IssuedAt(见 IssuedAtNow)，所以 SetNotBeforeWithErr 不需要等待，返回之后签发的 token(比如修改密码后重新登录)
+ * 都有效；其他进程中同一毫秒签发的仍然无效。
+ * 没有 IssuedAt 的是之前写入的 token，视为早于任何 NotBefore。
+ *
+ * uid 的 NotBefore 由 Store.Uid、Rotate 及 SetOrUseOld(不复用已经撤销的 token)与 token 一起检查；
+ * 全局的 NotBefore 每个进程缓存 notBefore.cache 秒，所以全局的设置在其他进程中最多延迟这么久生效。
+ * 降级缓存(见 degrade.go)中的 token 只在设置的进程中立即清除
+ */
+
+// NotBeforer 支持 NotBefore 的 Store 实现此接口，并在 Uid 中检查 uid 的 NotBefore
+type NotBeforer interface {
+  // SetNotBefore uid 为 "" 时设置全局的；ttl 为 0 时不过期
+  SetNotBefore(ctx context.Context, uid string, t time.Time, ttl time.Duration) error
+  // NotBefore uid 为 "" 时读取全局的，没有设置时返回零值
+  NotBefore(ctx context.Context, uid string) (time.Time, error)
+}
+
+var ErrNotBeforeNotSupported = errors.New("token db: the store does not support not-before")
+
+func (t *timeoutStore) SetNotBefore(ctx context.Context, uid string, at time.Time, ttl time.Duration) error {
+  s, ok := t.Store.(NotBeforer)
+  if !ok {
+    return ErrNotBeforeNotSupported
+  }
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return s.SetNotBefore(ctx, uid, at, ttl)
+  })
+}
+
+func (t *timeoutStore) NotBefore(ctx context.Context, uid string) (time.Time, error) {
+  s, ok := t.Store.(NotBeforer)
+  if !ok {
+    return time.Time{}, ErrNotBeforeNotSupported
+  }
+
+  var at time.Time
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    at, err = s.NotBefore(ctx, uid)
+    return
+  })
+  if err != nil {
+    return time.Time{}, err
+  }
+  return at, nil
+}
+
+// validSince 供 Store 的实现者使用：IssuedAt 晚于 notBefore(精确到毫秒)，notBefore 为零值时总是有效
+func validSince(issuedAt time.Time, notBefore time.Time) bool {
+  if notBefore.IsZero() {
+    return true
+  }
+  return !issuedAt.IsZero() && unixMs(issuedAt) > unixMs(notBefore)
+}
+
+// issuedClock 本进程中签发时间与 NotBefore 的先后，见 IssuedAtNow
+type issuedClock struct {
+  mu sync.Mutex
+  // 本进程最后设置的不晚于当时的 NotBefore(unix 毫秒)
+  notBefore int64
+  // 最后一次推后签发时间时的实际时间及推后的签发时间(unix 毫秒)
+  bumpedAt int64
+  bumped   int64
+}
+
+var clock = &issuedClock{}
+
+func (c *issuedClock) issuedAt(now time.Time) time.Time {
+  ms := unixMs(now)
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if ms <= c.notBefore {
+    c.bumpedAt, c.bumped = ms, c.notBefore+1
+    ms = c.bumped
+  }
+  return fromMs(ms)
+}
+
+// notBeforeOf 写入的 NotBefore，精确到毫秒。推后签发时间的 token 实际在 t 之前签发时，NotBefore 不能早于其签发时间
+func (c *issuedClock) notBeforeOf(t time.Time, now time.Time) time.Time {
+  ms := unixMs(t)
+  // 以后的 NotBefore 之前签发的 token 本就无效，不需要推后之后签发的
+  future := ms > unixMs(now)
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if ms >= c.bumpedAt && ms < c.bumped {
+    ms = c.bumped
+  }
+  if !future && ms > c.notBefore {
+    c.notBefore = ms
+  }
+  return fromMs(ms)
+}
+
+// IssuedAtNow 签发 token 时使用的时间，精确到毫秒。与本进程最后设置的 NotBefore 在同一毫秒时推后到其之后，
+// 使 SetNotBeforeWithErr 返回之后签发的 token 都有效。签名的 token(token 包)同样使用
+func IssuedAtNow() time.Time {
+  return clock.issuedAt(time.Now())
+}
+
+func laterTime(a, b time.Time) time.Time {
+  if a.After(b) {
+    return a
+  }
+  return b
+}
+
+// notBeforeTTL 之前签发的 token 都已经过期后，NotBefore 就不再需要；没有配置 AbsoluteTTL 时，token 可以一直刷新，所以不过期
+func notBeforeTTL() time.Duration {
+  return absoluteTTL()
+}
+
+type notBeforeCache struct {
+  mu        sync.Mutex
+  at        time.Time
+  fetchedAt time.Time
+  // 正在读取时不为 nil，读取结束时关闭，同一时间只有一个读取
+  fetching chan struct{}
+  // 每次 set 加一，读取期间 set 过时丢弃读取的值
+  version int64
+}
+
+var globalNotBefore = &notBeforeCache{}
+
+func notBeforeCacheWindow() time.Duration {
+  return time.Duration(confValue.NotBefore.CacheSeconds) * time.Second
+}
+
+// get 全局的 NotBefore。读取时不持有锁：已经有值时，其他调用者不等待，使用之前的值；
+// 读取失败时在这一周期内使用之前的值
+func (c *notBeforeCache) get(ctx context.Context) time.Time {
+  c.mu.Lock()
+  if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < notBeforeCacheWindow() {
+    defer c.mu.Unlock()
+    return c.at
+  }
+
+  if c.fetching != nil {
+    fetching, fetched, at := c.fetching, !c.fetchedAt.IsZero(), c.at
+    c.mu.Unlock()
+    if fetched {
+      return at
+    }
+    // 还没有任何值，等待正在进行的读取
+    select {
+    case <-fetching:
+    case <-ctx.Done():
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.at
+  }
+
+  fetching, version := make(chan struct{}), c.version
+  c.fetching = fetching
+  c.mu.Unlock()
+
+  at, err := c.fetch(ctx)
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  close(fetching)
+  c.fetching = nil
+  c.fetchedAt = time.Now()
+
+  if err != nil || version != c.version {
+    return c.at
+  }
+  // 其他进程设置了新的值，降级缓存中的 token 可能已经无效
+  if at.After(c.at) {
+    recentTokens.reset()
+  }
+  c.at = at
+  return c.at
+}
+
+func (c *notBeforeCache) fetch(ctx context.Context) (time.Time, error) {
+  s, ok := currentStore().(NotBeforer)
+  if !ok {
+    return time.Time{}, ErrNotBeforeNotSupported
+  }
+
+  at, err := s.NotBefore(ctx, "")
+  if err != nil && !errors.Is(err, ErrNotBeforeNotSupported) {
+    _, logger := log.WithCtx(ctx)
+    logger.Warning(fmt.Sprintf("read the global not-before error, use the last one, %s", err))
+  }
+  return at, err
+}
+
+// reset 更换 Store 时，之前的值不再有效
+func (c *notBeforeCache) reset() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.at = time.Time{}
+  c.fetchedAt = time.Time{}
+  c.version++
+}
+
+func (c *notBeforeCache) set(at time.Time) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.at = at
+  c.fetchedAt = time.Now()
+  c.version++
+}
+
+// SetNotBeforeWithErr uid 的 IssuedAt 不晚于 t(精确到毫秒)的 token 都无效，比如修改密码后传入 time.Now()。
+// 返回之后本进程签发的 token 都有效
+func SetNotBeforeWithErr(ctx context.Context, uid string, t time.Time) error {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db")
+
+  if uid == "" {
+    panic("token db: uid is empty, use SetGlobalNotBeforeWithErr to set the global not-before")
+  }
+
+  s, ok := currentStore().(NotBeforer)
+  if !ok {
+    return ErrNotBeforeNotSupported
+  }
+
+  t = clock.notBeforeOf(t, time.Now())
+  logger.Info(fmt.Sprintf("set not-before(%s) of uid(%s)", t, uid))
+  if err := s.SetNotBefore(ctx, uid, t, notBeforeTTL()); err != nil {
+    return err
+  }
+  recentTokens.delUid(uid, "")
+  return nil
+}
+
+func SetNotBefore(ctx context.Context, uid string, t time.Time) {
+  _, logger := log.WithCtx(ctx)
+  must(logger, SetNotBeforeWithErr(ctx, uid, t))
+}
+
+// SetGlobalNotBeforeWithErr 所有 uid 的 IssuedAt 不晚于 t 的 token 都无效，其他进程中最多延迟 notBefore.cache 秒生效。
+// 与 SetNotBeforeWithErr 一样，返回之后本进程签发的 token 都有效
+func SetGlobalNotBeforeWithErr(ctx context.Context, t time.Time) error {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db")
+
+  s, ok := currentStore().(NotBeforer)
+  if !ok {
+    return ErrNotBeforeNotSupported
+  }
+
+  t = clock.notBeforeOf(t, time.Now())
+  logger.Info(fmt.Sprintf("set the global not-before(%s)", t))
+  if err := s.SetNotBefore(ctx, "", t, notBeforeTTL()); err != nil {
+    return err
+  }
+  globalNotBefore.set(t)
+  recentTokens.reset()
+  return nil
+}
+
+func SetGlobalNotBefore(ctx context.Context, t time.Time) {
+  _, logger := log.WithCtx(ctx)
+  must(logger, SetGlobalNotBeforeWithErr(ctx, t))
+}
+
+// GlobalNotBefore 全局的 NotBefore，每个进程缓存 notBefore.cache 秒，没有设置或者读取失败时返回零值
+func GlobalNotBefore(ctx context.Context) time.Time {
+  return globalNotBefore.get(ctx)
+}
+
+// NotBeforeWithErr uid 的 NotBefore 与全局的 NotBefore 中较晚的一个，都没有设置时返回零值
+func NotBeforeWithErr(ctx context.Context, uid string) (time.Time, error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db")
+
+  s, ok := currentStore().(NotBeforer)
+  if !ok {
+    return time.Time{}, ErrNotBeforeNotSupported
+  }
+
+  at, err := s.NotBefore(ctx, uid)
+  if err != nil {
+    return time.Time{}, err
+  }
+  return laterTime(at, globalNotBefore.get(ctx)), nil
+}
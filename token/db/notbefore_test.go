@@ -0,0 +1,181 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestNotBefore(t *testing.T) {
+  useMemoryStore(t)
+  ctx := context.Background()
+
+  old := newToken(t, "t0", Value{Uid: "u1", ClientId: "c1"})
+  other := newToken(t, "t1", Value{Uid: "u2", ClientId: "c1"})
+
+  SetNotBefore(ctx, "u1", time.Now())
+  if _, err := old.UidWithErr(); !errors.Is(err, ErrExpired) {
+    t.Fatalf("issued before: %v", err)
+  }
+  if _, err := other.UidWithErr(); err != nil {
+    t.Fatalf("other uid: %v", err)
+  }
+  // 返回之后签发的 token 有效
+  if _, err := newToken(t, "t2", Value{Uid: "u1", ClientId: "c1"}).UidWithErr(); err != nil {
+    t.Fatalf("issued after: %v", err)
+  }
+
+  SetGlobalNotBefore(ctx, time.Now())
+  for _, token := range []string{"t1", "t2"} {
+    if _, err := New(ctx, token).UidWithErr(); !errors.Is(err, ErrExpired) {
+      t.Errorf("%s after global: %v", token, err)
+    }
+  }
+}
+
+func TestSetOrUseOldAfterNotBefore(t *testing.T) {
+  useMemoryStore(t)
+  ctx := context.Background()
+
+  d := New(ctx, "t0")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c1"})
+  SetNotBefore(ctx, "u1", time.Now())
+
+  // 原有的 token 已经撤销，不再复用
+  d = New(ctx, "t1")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c1"})
+  if d.RealToken() != "t1" {
+    t.Fatalf("reused the revoked token: %s", d.RealToken())
+  }
+  if uid, err := d.UidWithErr(); err != nil || uid != "u1" {
+    t.Fatalf("uid(%s), %v", uid, err)
+  }
+
+  SetGlobalNotBefore(ctx, time.Now())
+  d = New(ctx, "t2")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c1"})
+  if d.RealToken() != "t2" {
+    t.Fatalf("reused the token revoked by the global not-before: %s", d.RealToken())
+  }
+
+  // 没有撤销的仍然复用
+  d = New(ctx, "t3")
+  d.SetOrUseOld(&Value{Uid: "u1", ClientId: "c1"})
+  if d.RealToken() != "t2" {
+    t.Errorf("use old: %s", d.RealToken())
+  }
+}
+
+func TestValidSince(t *testing.T) {
+  nb := time.Unix(1000, 500)
+  tests := []struct {
+    issuedAt time.Time
+    valid    bool
+  }{
+    {time.Time{}, false},
+    {time.Unix(999, 0), false},
+    {time.Unix(1000, 0), false},
+    {time.Unix(1000, 900), false},
+    {time.Unix(1000, int64(time.Millisecond)), true},
+    {time.Unix(1001, 0), true},
+  }
+  for _, test := range tests {
+    if validSince(test.issuedAt, nb) != test.valid {
+      t.Errorf("%v: %v", test.issuedAt, !test.valid)
+    }
+  }
+  if !validSince(time.Time{}, time.Time{}) {
+    t.Error("zero not-before")
+  }
+}
+
+func TestIssuedClock(t *testing.T) {
+  c := &issuedClock{}
+  now := time.Unix(1600000000, 0)
+
+  // 以后的 NotBefore 不推后之后签发的
+  if nb := c.notBeforeOf(now.Add(time.Second), now); !nb.Equal(now.Add(time.Second)) {
+    t.Fatalf("future: %v", nb)
+  }
+  if at := c.issuedAt(now); !at.Equal(now) {
+    t.Fatalf("issued at: %v", at)
+  }
+
+  nb := c.notBeforeOf(now, now)
+  // 同一毫秒中签发的推后到 NotBefore 之后
+  first := c.issuedAt(now)
+  if !validSince(first, nb) {
+    t.Fatalf("issued after the not-before: %v, %v", first, nb)
+  }
+  // 同一毫秒中再次设置的 NotBefore 不早于推后的签发时间
+  nb = c.notBeforeOf(now, now)
+  if validSince(first, nb) {
+    t.Fatalf("issued before the second not-before: %v, %v", first, nb)
+  }
+  if second := c.issuedAt(now); !validSince(second, nb) {
+    t.Errorf("issued after the second not-before: %v, %v", second, nb)
+  }
+  if at := c.issuedAt(now.Add(time.Second)); !at.Equal(now.Add(time.Second)) {
+    t.Errorf("next second: %v", at)
+  }
+}
+
+func TestDecodeMs(t *testing.T) {
+  at := time.Unix(1600000000, int64(123*time.Millisecond))
+  if got := decodeMs(encodeMs(at)); !got.Equal(at) {
+    t.Errorf("ms: %v", got)
+  }
+  // 之前以秒写入的
+  if got := fromMap(map[string]string{vIssuedAt: "1600000000"}).IssuedAt; !got.Equal(time.Unix(1600000000, 0)) {
+    t.Errorf("seconds: %v", got)
+  }
+  if got := fromMap(map[string]string{vIssuedAt: encodeMs(time.Time{})}).IssuedAt; !got.IsZero() {
+    t.Errorf("zero: %v", got)
+  }
+}
+
+// blockingStore 读取全局的 NotBefore 时阻塞，直到 release 关闭
+type blockingStore struct {
+  *memoryStore
+  release chan struct{}
+}
+
+func (s *blockingStore) NotBefore(ctx context.Context, uid string) (time.Time, error) {
+  <-s.release
+  return s.memoryStore.NotBefore(ctx, uid)
+}
+
+func TestNotBeforeCacheDoesNotBlock(t *testing.T) {
+  m := useMemoryStore(t)
+  confValue.NotBefore.CacheSeconds = 10
+
+  at := time.Unix(1000, 0)
+  c := &notBeforeCache{at: at, fetchedAt: time.Now().Add(-time.Hour)}
+  s := &blockingStore{memoryStore: m, release: make(chan struct{})}
+  SetStore(s)
+
+  done := make(chan time.Time)
+  go func() {
+    done <- c.get(context.Background())
+  }()
+  // 等待第一个调用开始读取
+  for {
+    c.mu.Lock()
+    fetching := c.fetching != nil
+    c.mu.Unlock()
+    if fetching {
+      break
+    }
+    time.Sleep(time.Millisecond)
+  }
+
+  if got := c.get(context.Background()); !got.Equal(at) {
+    t.Fatalf("concurrent get: %v", got)
+  }
+  close(s.release)
+  // 存储中没有设置
+  if got := <-done; !got.IsZero() {
+    t.Fatalf("fetched: %v", got)
+  }
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "sync"
+  "time"
+)
+
+/**
+ * 生命周期事件：生成、复用、轮换、淘汰及删除 token 时通知 AddObserver 注册的 Observer，可用于审计日志、监控指标及通知用户。
+ *
+ * 存储中的 token 的事件在本包中产生，直接调用本包的接口(比如 DelAllForUid)同样会通知；
+ * 签名的 token 及验证的事件由 token 包通过 Notify 产生，见 token/observer.go。
+ *
+ * Observer 在调用者的 goroutine 中同步调用，应尽快返回，耗时的操作需自行异步处理；Observer 的 panic 只记录日志
+ */
+
+type EventKind string
+
+const (
+  // EventNew 生成了新的 token：OverWrite、SetOrUseOld(没有可复用的)，token 包的 NewStateless、NewJWT，
+  // NewPair 为其 refresh token
+  EventNew EventKind = "new"
+  // EventReuse SetOrUseOld 复用了原有的 token
+  EventReuse EventKind = "reuse"
+  // EventResumed 验证 token 成功(token 包的 UidOrInvalid、ResumeWithErr 等)
+  EventResumed EventKind = "resumed"
+  // EventResumeFailed 验证 token 失败，Event.Err 为失败的原因
+  EventResumeFailed EventKind = "resumeFailed"
+  // EventEvicted 因设备数限制、互斥分组或者同一个 ClientId 新的登录而淘汰的 token，Event.Reason 为
+  // ReasonEvicted、ReasonExclusive 或者 ReasonReplaced，见 eviction.go。Find、FindAll 之前的淘汰同样通知
+  EventEvicted EventKind = "evicted"
+  // EventRotated refresh token 轮换为新的 token，Event.Token 为轮换之前的，见 family.go
+  EventRotated EventKind = "rotated"
+  // EventRefreshReused 已经轮换的 refresh token 再次使用，其 family 已经撤销，Event.Token 为再次使用的 refresh token
+  EventRefreshReused EventKind = "refreshReused"
+  // EventDel 删除 token，比如退出登录
+  EventDel EventKind = "del"
+  // EventDelClientId DelClientIdForUid
+  EventDelClientId EventKind = "delClientId"
+  // EventDelAll DelAllForUid，Event.ClientId 及 Event.Token 为空
+  EventDelAll EventKind = "delAll"
+)
+
+type Event struct {
+  Kind     EventKind
+  Uid      string
+  // 未知时为空，比如验证存储中的 token 时
+  ClientId string
+  // 经过 Redact 处理的 token。存储中只有 token 的 hash(见 hash.go)，不知道 token 本身时为空，
+  // 比如淘汰的 token 及 Find 得到的 token
+  Token string
+  // ReasonEvicted、ReasonExclusive、ReasonReplaced、ReasonSignedOut，验证失败时为墓碑中的原因(见 Tombstone)，其他为空
+  Reason string
+  // 只有 EventResumeFailed 才有
+  Err error
+  At  time.Time
+}
+
+type Observer interface {
+  OnEvent(ctx context.Context, event *Event)
+}
+
+// ObserverFunc 使普通函数可以作为 Observer
+type ObserverFunc func(ctx context.Context, event *Event)
+
+func (f ObserverFunc) OnEvent(ctx context.Context, event *Event) {
+  f(ctx, event)
+}
+
+var (
+  observers   []Observer
+  observersMu sync.RWMutex
+)
+
+// AddObserver 应在使用 token 之前调用
+func AddObserver(o Observer) {
+  observersMu.Lock()
+  defer observersMu.Unlock()
+  observers = append(observers, o)
+}
+
+func currentObservers() []Observer {
+  observersMu.RLock()
+  defer observersMu.RUnlock()
+  return observers
+}
+
+// Redact 只保留 token 的前后几个字符，用于日志等不能泄露 token 的地方
+func Redact(token string) string {
+  const keep = 4
+  if token == "" {
+    return ""
+  }
+  if len(token) <= 4*keep {
+    return "***"
+  }
+  return token[:keep] + "***" + token[len(token)-keep:]
+}
+
+// Observing 是否有 Observer，没有时可以省去准备事件的开销
+func Observing() bool {
+  return len(currentObservers()) != 0
+}
+
+// Notify 通知所有的 Observer，event.Token 为 token 本身，由 Notify 做 Redact 处理。
+// 每个 Observer 得到的都是 event 的副本，不修改 event，Observer 之间也互不影响
+func Notify(ctx context.Context, event *Event) {
+  obs := currentObservers()
+  if len(obs) == 0 {
+    return
+  }
+
+  e := *event
+  e.Token = Redact(e.Token)
+  e.At = time.Now()
+  for _, o := range obs {
+    c := e
+    callObserver(ctx, o, &c)
+  }
+}
+
+func callObserver(ctx context.Context, o Observer, event *Event) {
+  defer func() {
+    if r := recover(); r != nil {
+      _, logger := log.WithCtx(ctx)
+      logger.Error(fmt.Sprintf("observer panic on event(%s) of uid(%s), %v", event.Kind, event.Uid, r))
+    }
+  }()
+  o.OnEvent(ctx, event)
+}
+
+// eventToken key 为存储中使用的值，hash 保存时不知道 token 本身，为空
+func eventToken(key string) string {
+  if isHashed(key) {
+    return ""
+  }
+  return key
+}
+
+// notifyEvicted incoming 为 nil 时(Find、FindAll 之前的淘汰)，都是 ReasonEvicted
+func notifyEvicted(ctx context.Context, uid string, incoming *Value, evicted []Device) {
+  for _, device := range evicted {
+    Notify(ctx, &Event{Kind: EventEvicted, Uid: uid, ClientId: device.ClientId, Token: eventToken(device.Token),
+      Reason: evictedReason(incoming, device)})
+  }
+}
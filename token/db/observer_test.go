@@ -0,0 +1,160 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "sync"
+  "testing"
+)
+
+var (
+  recorderOnce sync.Once
+  recorded     []Event
+  recordedMu   sync.Mutex
+)
+
+// recordEvents 从此开始记录事件，Observer 只能添加，所以所有的测试共用一个
+func recordEvents(t *testing.T) {
+  recorderOnce.Do(func() {
+    AddObserver(ObserverFunc(func(ctx context.Context, event *Event) {
+      recordedMu.Lock()
+      defer recordedMu.Unlock()
+      recorded = append(recorded, *event)
+    }))
+  })
+
+  recordedMu.Lock()
+  defer recordedMu.Unlock()
+  recorded = nil
+}
+
+// events 记录的事件，每个为 "kind|uid|clientId|token|reason"
+func events() string {
+  recordedMu.Lock()
+  defer recordedMu.Unlock()
+
+  ret := make([]string, 0, len(recorded))
+  for _, e := range recorded {
+    ret = append(ret, strings.Join([]string{string(e.Kind), e.Uid, e.ClientId, e.Token, e.Reason}, "|"))
+  }
+  recorded = nil
+  return strings.Join(ret, "\n")
+}
+
+func expectEvents(t *testing.T, name string, expected ...string) {
+  t.Helper()
+  if got := events(); got != strings.Join(expected, "\n") {
+    t.Errorf("%s:\n%s\nexpected:\n%s", name, got, strings.Join(expected, "\n"))
+  }
+}
+
+func TestObserverEvents(t *testing.T) {
+  useMemoryStore(t)
+  recordEvents(t)
+  ctx := context.Background()
+
+  t1 := "token-1-aaaaaaaaaaaa"
+  t2 := "token-2-bbbbbbbbbbbb"
+  newToken(t, t1, Value{Uid: "u1", ClientId: "c1"})
+  newToken(t, t2, Value{Uid: "u1", ClientId: "c1"})
+  expectEvents(t, "replace",
+    "new|u1|c1|"+Redact(t1)+"|",
+    "new|u1|c1|"+Redact(t2)+"|",
+    "evicted|u1|c1|"+Redact(t1)+"|"+ReasonReplaced)
+
+  New(ctx, t2).Del()
+  expectEvents(t, "del", "del|u1|c1|"+Redact(t2)+"|")
+
+  newToken(t, t1, Value{Uid: "u1", ClientId: "c1"})
+  newToken(t, t2, Value{Uid: "u1", ClientId: "c2"})
+  events()
+  DelClientIdForUid(ctx, "u1", "c1")
+  DelAllForUid(ctx, "u1")
+  expectEvents(t, "del by uid",
+    "delClientId|u1|c1|"+Redact(t1)+"|"+ReasonSignedOut,
+    "delAll|u1|||"+ReasonSignedOut)
+}
+
+func TestObserverEvictedByFind(t *testing.T) {
+  m := useMemoryStore(t)
+  recordEvents(t)
+  ctx := context.Background()
+
+  for i := 1; i <= 3; i++ {
+    newToken(t, fmt.Sprintf("token-%d-aaaaaaaaaaaa", i), Value{Uid: "u1", ClientId: fmt.Sprint("c", i)})
+    advance(m, 1)
+  }
+  events()
+
+  confValue.AllowDevices.Min = 1
+  confValue.AllowDevices.Max = 2
+  FindAll(ctx, "u1")
+  expectEvents(t, "find",
+    "evicted|u1|c1|"+Redact("token-1-aaaaaaaaaaaa")+"|"+ReasonEvicted,
+    "evicted|u1|c2|"+Redact("token-2-aaaaaaaaaaaa")+"|"+ReasonEvicted)
+}
+
+func TestObserverRotate(t *testing.T) {
+  useMemoryStore(t)
+  recordEvents(t)
+  confValue.Refresh.ReuseWindowMinutes = 10
+
+  r0 := "refresh-0-aaaaaaaaaaaa"
+  d := newToken(t, r0, Value{Uid: "u1", ClientId: "c1", RefreshOnly: true})
+  d.Rotate("refresh-1-aaaaaaaaaaaa")
+  _, _ = New(d.ctx, r0).RotateWithErr("refresh-2-aaaaaaaaaaaa")
+  expectEvents(t, "rotate",
+    "new|u1|c1|"+Redact(r0)+"|",
+    "rotated|u1|c1|"+Redact(r0)+"|",
+    "refreshReused|u1|c1|"+Redact(r0)+"|")
+}
+
+func TestObserverHashedToken(t *testing.T) {
+  useMemoryStore(t)
+  recordEvents(t)
+  confValue.HashTokens.Secret = "secret"
+
+  t1 := "token-1-aaaaaaaaaaaa"
+  newToken(t, t1, Value{Uid: "u1", ClientId: "c1"})
+  newToken(t, "token-2-bbbbbbbbbbbb", Value{Uid: "u1", ClientId: "c1"})
+  DelClientIdForUid(context.Background(), "u1", "c1")
+  // 存储中只有 hash，不知道 token 本身
+  expectEvents(t, "hashed",
+    "new|u1|c1|"+Redact(t1)+"|",
+    "new|u1|c1|"+Redact("token-2-bbbbbbbbbbbb")+"|",
+    "evicted|u1|c1||"+ReasonReplaced,
+    "delClientId|u1|c1||"+ReasonSignedOut)
+}
+
+func TestNotifyCopiesEvent(t *testing.T) {
+  observersMu.Lock()
+  saved := observers
+  observers = nil
+  observersMu.Unlock()
+  t.Cleanup(func() {
+    observersMu.Lock()
+    defer observersMu.Unlock()
+    observers = saved
+  })
+
+  var seen []Event
+  AddObserver(ObserverFunc(func(ctx context.Context, event *Event) {
+    seen = append(seen, *event)
+    event.Uid = "changed"
+    event.Token = "changed"
+  }))
+  AddObserver(ObserverFunc(func(ctx context.Context, event *Event) {
+    seen = append(seen, *event)
+  }))
+
+  event := &Event{Kind: EventNew, Uid: "u1", Token: "0123456789abcdefgh"}
+  Notify(context.Background(), event)
+
+  if len(seen) != 2 || seen[1].Uid != "u1" || seen[1].Token != seen[0].Token || seen[1].Token != Redact(event.Token) {
+    t.Errorf("seen by the next observer: %+v", seen)
+  }
+  if event.Uid != "u1" || event.Token != "0123456789abcdefgh" || !event.At.IsZero() {
+    t.Errorf("caller's event: %+v", event)
+  }
+}
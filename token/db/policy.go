@@ -0,0 +1,81 @@
+package db
+
+import (
+  "time"
+)
+
+/**
+ * 按 Value.ClientType 区分的策略：不同类型的客户端可以配置不同的 MaxTTL 及设备数(config 中的 clientTypes)，
+ * 没有配置的类型使用全局的 maxTTL 及 allowDevices。
+ *
+ * 淘汰时 uid 的 token 按类型分组，每一组只在同类型的 token 中淘汰，比如最多 1 个 tv、3 个 phone；
+ * 没有单独配置设备数的类型在同一组中，使用全局的 allowDevices
+ */
+
+func clientTypePolicy(clientType string) (*clientTypeConfig, bool) {
+  if clientType == "" {
+    return nil, false
+  }
+
+  for i := range confValue.ClientTypes {
+    if confValue.ClientTypes[i].Type == clientType {
+      return &confValue.ClientTypes[i], true
+    }
+  }
+  return nil, false
+}
+
+func adjustDevices(d Devices) Devices {
+  if d.Min >= d.Max {
+    d.Max = 2 * d.Min
+  }
+  return d
+}
+
+// limitOf 写入 clientType 的 token 时需要遵守的限制，TTL 不超过 AbsoluteTTL
+func limitOf(clientType string) Limit {
+  days := confValue.MaxTTL
+  if p, ok := clientTypePolicy(clientType); ok && p.MaxTTL > 0 {
+    days = p.MaxTTL
+  }
+  ttl := time.Duration(days) * 24 * time.Hour
+  if absoluteTTL() > 0 && absoluteTTL() < ttl {
+    ttl = absoluteTTL()
+  }
+
+  devices := make(map[string]Devices, len(confValue.ClientTypes))
+  for _, p := range confValue.ClientTypes {
+    // 没有配置设备数的类型与其他类型在同一组
+    if p.Type == "" || (p.AllowDevices.Min <= 0 && p.AllowDevices.Max <= 0) {
+      continue
+    }
+    devices[p.Type] = adjustDevices(Devices{Min: p.AllowDevices.Min, Max: p.AllowDevices.Max})
+  }
+
+  return Limit{
+    TTL:         ttl,
+    MinDevices:  confValue.AllowDevices.Min,
+    MaxDevices:  confValue.AllowDevices.Max,
+    Devices:     devices,
+    Eviction:    currentEviction(),
+    MinIssuedAt: minIssuedAt(time.Now()),
+  }
+}
+
+// MaxTTL clientType 的 token 写入时的有效期
+func MaxTTL(clientType string) time.Duration {
+  return limitOf(clientType).TTL
+}
+
+// maxTTLWithErr 刷新 TTL 时的最大值，配置了 clientTypes 时需要读取 Value.ClientType
+func (db *DB) maxTTLWithErr() (time.Duration, error) {
+  if len(confValue.ClientTypes) == 0 {
+    return db.maxTTL, nil
+  }
+
+  value, err := db.ValueWithErr()
+  if err != nil {
+    return 0, err
+  }
+  return MaxTTL(value.ClientType), nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * 补偿：写入或者删除失败、uidKey 没有过期时间等，都可能留下无效的数据:
+ *   1、uid 的索引中指向了已经不存在(比如已过期)的 token
+ *   2、token 的数据没有 uid，或者 uid 的索引中没有指向它(孤儿 token)
+ * Reconcile 扫描所有的数据，删除以上无效的数据，并报告修复的结果
+ */
+
+type ReconcileReport struct {
+  ScannedUids   int64
+  ScannedTokens int64
+  // 删除的 uid 索引中指向不存在 token 的项
+  DanglingRefs int64
+  // 删除的孤儿 token
+  OrphanTokens int64
+}
+
+func (r ReconcileReport) String() string {
+  return fmt.Sprintf("scanned uids: %d, scanned tokens: %d, removed dangling refs: %d, removed orphan tokens: %d",
+    r.ScannedUids, r.ScannedTokens, r.DanglingRefs, r.OrphanTokens)
+}
+
+// Reconciler 支持补偿的 Store 实现此接口
+type Reconciler interface {
+  Reconcile(ctx context.Context) (ReconcileReport, error)
+}
+
+var ErrReconcileNotSupported = errors.New("token db: the store does not support reconcile")
+
+func (t *timeoutStore) Reconcile(ctx context.Context) (ReconcileReport, error) {
+  r, ok := t.Store.(Reconciler)
+  if !ok {
+    return ReconcileReport{}, ErrReconcileNotSupported
+  }
+
+  // 扫描的时间与数据量有关，不使用单个操作的超时，只遵守 ctx
+  return r.Reconcile(ctx)
+}
+
+// Reconcile 执行一次补偿
+func Reconcile(ctx context.Context) (ReconcileReport, error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db reconcile")
+
+  r, ok := currentStore().(Reconciler)
+  if !ok {
+    return ReconcileReport{}, ErrReconcileNotSupported
+  }
+
+  report, err := r.Reconcile(ctx)
+  if err != nil {
+    logger.Error(err)
+    return report, err
+  }
+
+  logger.Info(report.String())
+  return report, nil
+}
+
+// StartReconciler 在后台每隔 interval 执行一次 Reconcile，直到 ctx 结束
+func StartReconciler(ctx context.Context, interval time.Duration) {
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case <-ticker.C:
+        _, _ = Reconcile(ctx)
+      }
+    }
+  }()
+}
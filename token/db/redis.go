@@ -0,0 +1,774 @@
+package db
+
+import (
+  "context"
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "github.com/go-redis/redis"
+  "github.com/xpwu/go-log/log"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  tokenK  = "token:"
+  uidK    = "uid:"
+  familyK = "family:"
+)
+
+/**
+ *
+ * 存储方式：
+ *
+ * tokenKey = 'token:' + token
+ *
+ * tokenKey ---> Value  (0 < TTL <= maxTTL of Value.ClientType, 见 policy.go)
+ *
+ * uidKey = 'uid:' + uid
+ *
+ * uidKey ---> {ClientId_1:token_1, ClientId_2:token_2, ...}
+ *
+ * familyKey = 'family:' + uid，见 family.go
+ *
+ * notBeforeKey = 'notBefore:' + uid ---> unix 毫秒(之前写入的为 unix 秒)，全局的为 'notBefore'，见 notbefore.go
+ *
+ * 以 tokenKey 作为判断的标准，写的时候后写，删的时候先删
+ *
+ * cluster 模式下，同一个 uid 的 uidKey 及其所有 tokenKey 使用相同的 hash tag，保证在同一个 slot 中:
+ *
+ * tag = slotTag(uid)
+ * token = tag + '.' + id
+ * uidKey = 'uid:{' + tag + '}' + uid
+ * familyKey = 'family:{' + tag + '}' + uid
+ * notBeforeKey = 'notBefore:{' + tag + '}' + uid
+ * tokenKey = 'token:{' + tag + '}' + token
+ *
+ */
+
+type redisStore struct {
+  client  redis.UniversalClient
+  cluster bool
+}
+
+func NewRedisStore(client *redis.Client) Store {
+  return &redisStore{client: client}
+}
+
+// NewRedisClusterStore token 必须由 SlotToken 生成，否则无法定位其 slot
+func NewRedisClusterStore(client *redis.ClusterClient) Store {
+  return &redisStore{client: client, cluster: true}
+}
+
+const slotTagSeparator = "."
+
+func slotTag(uid string) string {
+  sum := sha1.Sum([]byte(uid))
+  return hex.EncodeToString(sum[:4])
+}
+
+func (r *redisStore) SlotToken(uid string, token string) string {
+  if !r.cluster {
+    return token
+  }
+  return slotTag(uid) + slotTagSeparator + token
+}
+
+func (r *redisStore) uidKey(uid string) string {
+  if !r.cluster {
+    return uidK + uid
+  }
+  return uidK + "{" + slotTag(uid) + "}" + uid
+}
+
+func (r *redisStore) familyKey(uid string) string {
+  if !r.cluster {
+    return familyK + uid
+  }
+  return familyK + "{" + slotTag(uid) + "}" + uid
+}
+
+// tokenPrefix uid 的所有 token 的 key 前缀
+func (r *redisStore) tokenPrefix(uid string) string {
+  if !r.cluster {
+    return tokenK
+  }
+  return tokenK + "{" + slotTag(uid) + "}"
+}
+
+// tokenTag cluster 模式下 token 的 hash tag，包括 '{}'
+func (r *redisStore) tokenTag(token string) string {
+  if !r.cluster {
+    return ""
+  }
+
+  // 没有 tag 的 token 不是由 SlotToken 生成的，在 cluster 模式下不会有数据
+  i := strings.Index(token, slotTagSeparator)
+  if i < 0 {
+    return ""
+  }
+  return "{" + token[:i] + "}"
+}
+
+func (r *redisStore) tokenKey(token string) string {
+  return tokenK + r.tokenTag(token) + token
+}
+
+// storeErr redis.Nil 转为 ErrNotFound，其他错误都是 ErrStoreUnavailable
+func storeErr(logger *log.Logger, err error) error {
+  if err == nil {
+    return nil
+  }
+  if err == redis.Nil {
+    return ErrNotFound
+  }
+
+  logger.Error(err)
+  return StoreUnavailable(err)
+}
+
+func (r *redisStore) Value(ctx context.Context, token string) (value *Value, err error) {
+  _, logger := log.WithCtx(ctx)
+
+  m, err := r.client.HGetAll(r.tokenKey(token)).Result()
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+  if len(m) == 0 {
+    return nil, ErrNotFound
+  }
+
+  return fromMap(m), nil
+}
+
+// evictionArg 脚本中的 eviction 参数，见 evictLua。自定义的淘汰策略返回 ErrEvictionNotSupported
+func evictionArg(limit Limit) (string, error) {
+  strategy, err := evictionName(limit)
+  if err != nil {
+    return "", err
+  }
+
+  devices := limit.Devices
+  if devices == nil {
+    devices = map[string]Devices{}
+  }
+  data, err := json.Marshal(struct {
+    Min      int64              `json:"min"`
+    Max      int64              `json:"max"`
+    Devices  map[string]Devices `json:"devices"`
+    Strategy string             `json:"strategy"`
+  }{limit.MinDevices, limit.MaxDevices, devices, strategy})
+  if err != nil {
+    panic(err)
+  }
+  return string(data), nil
+}
+
+// scriptRetry 脚本执行时 uid 的索引中有没有声明的 token，脚本没有做任何修改，见 script.go
+const scriptRetry = "retry"
+
+// scriptRetries 同一个 uid 的写入一直在变化时，最多执行的次数
+const scriptRetries = 3
+
+// runWithTokens 读取 uid 的索引，执行 script，KEYS 为 keys 之后再加上索引中所有 token 的 key，
+// 脚本返回 {'retry'} 时重新读取索引后再执行
+func (r *redisStore) runWithTokens(script *redis.Script, uid string, keys []string,
+  args ...interface{}) (interface{}, error) {
+
+  prefix := r.tokenPrefix(uid)
+  for i := 0; i < scriptRetries; i++ {
+    tokens, err := r.client.HVals(r.uidKey(uid)).Result()
+    if err != nil {
+      return nil, err
+    }
+
+    all := make([]string, 0, len(keys)+len(tokens))
+    all = append(all, keys...)
+    for _, token := range tokens {
+      all = append(all, prefix+token)
+    }
+    res, err := script.Run(r.client, all, args...).Result()
+    if err != nil {
+      return nil, err
+    }
+    if ret := scriptStrings(res); len(ret) == 0 || ret[0] != scriptRetry {
+      return res, nil
+    }
+  }
+
+  return nil, fmt.Errorf("the tokens of uid(%s) keep changing, retried %d times", uid, scriptRetries)
+}
+
+// scriptStrings 脚本返回的数组
+func scriptStrings(res interface{}) []string {
+  ret := make([]string, 0)
+  if list, ok := res.([]interface{}); ok {
+    for _, v := range list {
+      str, _ := v.(string)
+      ret = append(ret, str)
+    }
+  }
+  return ret
+}
+
+// evictedOf 脚本返回的淘汰的 token，每一个为 clientId, token, clientType, latestTime, issuedAt, exclusive
+func evictedOf(ret []string) []Device {
+  evicted := make([]Device, 0, len(ret)/6)
+  for i := 0; i+5 < len(ret); i += 6 {
+    m := map[string]string{vClientType: ret[i+2], vLatestTime: ret[i+3], vIssuedAt: ret[i+4]}
+    v := fromMap(m)
+    device := Device{ClientId: ret[i], Token: ret[i+1], ClientType: v.ClientType, Exclusive: ret[i+5],
+      IssuedAt: v.IssuedAt}
+    // 不存在的 token 为零值
+    if ret[i+3] != "" {
+      device.LatestTime = v.LatestTime
+    }
+    evicted = append(evicted, device)
+  }
+  return evicted
+}
+
+// evictResult 淘汰相关的脚本返回 {'ok', head..., 淘汰的 token...} 或者 {'rejected'}
+func evictResult(res interface{}, head int) ([]string, []Device, error) {
+  ret := scriptStrings(res)
+  if len(ret) > 0 && ret[0] == evictRejected {
+    return nil, nil, ErrTooManyDevices
+  }
+  if len(ret) < 1+head || ret[0] != evictOk {
+    return nil, nil, StoreUnavailable(fmt.Errorf("unexpected result of evict script: %v", res))
+  }
+  return ret[1 : 1+head], evictedOf(ret[1+head:]), nil
+}
+
+func (r *redisStore) Uid(ctx context.Context, token string, minIssuedAt time.Time,
+  notBefore time.Time) (uid string, err error) {
+
+  _, logger := log.WithCtx(ctx)
+
+  // 没有uid的token直接删除；过期的token、早于 notBefore 的token及family已经撤销的token，由脚本做一次清除操作。
+  // familyKey 及 notBeforeKey 由 uid 得到，先读取 token 的 uid
+  tokenKey := r.tokenKey(token)
+  uid, err = r.client.HGet(tokenKey, vUid).Result()
+  if err == nil && uid == "" {
+    if err = r.client.Del(tokenKey).Err(); err == nil {
+      err = redis.Nil
+    }
+  }
+  if err == nil {
+    uid, err = uidScript.Run(r.client, []string{tokenKey, r.familyKey(uid), r.notBeforeKey(uid)}, uid,
+      unixMs(minIssuedAt), unixMs(notBefore)).String()
+  }
+  if err = storeErr(logger, err); err != ErrNotFound {
+    return
+  }
+
+  logger.Warning(fmt.Sprintf("have no token(%s) or the uid not exist", token))
+  return "", ErrNotFound
+}
+
+func (r *redisStore) Exists(ctx context.Context, token string) (bool, error) {
+  _, logger := log.WithCtx(ctx)
+  ret, err := r.client.Exists(r.tokenKey(token)).Result()
+
+  return ret == 1, storeErr(logger, err)
+}
+
+func (r *redisStore) TTL(ctx context.Context, token string) (ttl time.Duration, err error) {
+  _, logger := log.WithCtx(ctx)
+  ttl, err = r.client.TTL(r.tokenKey(token)).Result()
+
+  return ttl, storeErr(logger, err)
+}
+
+func (r *redisStore) Expire(ctx context.Context, token string, ttl time.Duration) error {
+  _, logger := log.WithCtx(ctx)
+  _, err := r.client.Expire(r.tokenKey(token), ttl).Result()
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) ExpireAndSetLatestTime(ctx context.Context, token string, ttl time.Duration,
+  latestTime time.Time) error {
+
+  _, logger := log.WithCtx(ctx)
+
+  err := expireAndSetLatestTimeScript.Run(r.client, []string{r.tokenKey(token)}, ttl.Milliseconds(),
+    encodeLastTime(latestTime)).Err()
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) OverWrite(ctx context.Context, token string, value *Value, limit Limit) ([]Device, error) {
+  _, logger := log.WithCtx(ctx)
+
+  eviction, err := evictionArg(limit)
+  if err != nil {
+    return nil, err
+  }
+
+  args := []interface{}{r.tokenPrefix(value.Uid), value.ClientId, token, limit.TTL.Milliseconds(),
+    eviction, value.ClientType, value.Exclusive}
+  res, err := r.runWithTokens(overWriteScript, value.Uid,
+    []string{r.uidKey(value.Uid), r.tokenKey(token), r.familyKey(value.Uid)}, mapArgs(args, value.toMap())...)
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+
+  _, evicted, err := evictResult(res, 0)
+  return evicted, err
+}
+
+func (r *redisStore) SetOrUseOld(ctx context.Context, token string, value *Value,
+  limit Limit) (realToken string, evicted []Device, err error) {
+
+  _, logger := log.WithCtx(ctx)
+
+  eviction, err := evictionArg(limit)
+  if err != nil {
+    return "", nil, err
+  }
+
+  args := []interface{}{r.tokenPrefix(value.Uid), value.ClientId, token, limit.TTL.Milliseconds(),
+    eviction, value.ClientType, value.Exclusive, encodeLastTime(value.LatestTime), unixMs(limit.MinIssuedAt),
+    unixMs(limit.NotBefore)}
+  res, err := r.runWithTokens(setOrUseOldScript, value.Uid,
+    []string{r.uidKey(value.Uid), r.familyKey(value.Uid), r.notBeforeKey(value.Uid), r.tokenKey(token)},
+    mapArgs(args, value.toMap())...)
+  if err = storeErr(logger, err); err != nil {
+    return "", nil, err
+  }
+
+  head, evicted, err := evictResult(res, 1)
+  if err != nil {
+    return "", nil, err
+  }
+  return head[0], evicted, nil
+}
+
+func (r *redisStore) SetAccess(ctx context.Context, token string, value *Value, ttl time.Duration) error {
+  _, logger := log.WithCtx(ctx)
+
+  _, err := r.client.TxPipelined(func(pipeliner redis.Pipeliner) error {
+    tokenKey := r.tokenKey(token)
+    pipeliner.HMSet(tokenKey, value.toMap())
+    pipeliner.PExpire(tokenKey, ttl)
+    return nil
+  })
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) Del(ctx context.Context, token string, value *Value) error {
+  _, logger := log.WithCtx(ctx)
+
+  _, err := r.client.Pipelined(func(pipeliner redis.Pipeliner) error {
+    pipeliner.Del(r.tokenKey(token))
+    pipeliner.HDel(r.uidKey(value.Uid), value.ClientId)
+    pipeliner.HDel(r.familyKey(value.Uid), value.ClientId)
+    return nil
+  })
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) DelClientId(ctx context.Context, uid string, clientId string) (token string, err error) {
+  _, logger := log.WithCtx(ctx)
+
+  token, err = r.client.HGet(r.uidKey(uid), clientId).Result()
+  if err = storeErr(logger, err); err != nil {
+    return "", err
+  }
+
+  _, err = r.client.Pipelined(func(pipeliner redis.Pipeliner) error {
+    pipeliner.Del(r.tokenKey(token))
+    pipeliner.HDel(r.uidKey(uid), clientId)
+    pipeliner.HDel(r.familyKey(uid), clientId)
+    return nil
+  })
+
+  return token, storeErr(logger, err)
+}
+
+func (r *redisStore) DelAll(ctx context.Context, uid string) error {
+  _, logger := log.WithCtx(ctx)
+
+  clients, err := r.client.HGetAll(r.uidKey(uid)).Result()
+  if err = storeErr(logger, err); err != nil {
+    return err
+  }
+
+  tokenKeys := make([]string, 0, len(clients))
+  for _, token := range clients {
+    tokenKeys = append(tokenKeys, r.tokenKey(token))
+  }
+
+  _, err = r.client.Pipelined(func(pipeliner redis.Pipeliner) error {
+    if len(tokenKeys) != 0 {
+      pipeliner.Del(tokenKeys...)
+    }
+    pipeliner.Del(r.uidKey(uid), r.familyKey(uid))
+    return nil
+  })
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) Find(ctx context.Context, uid string, clientId string) (token string, err error) {
+  _, logger := log.WithCtx(ctx)
+
+  token, err = r.client.HGet(r.uidKey(uid), clientId).Result()
+
+  return token, storeErr(logger, err)
+}
+
+func (r *redisStore) FindAll(ctx context.Context, uid string) (tokens []string, err error) {
+  _, logger := log.WithCtx(ctx)
+
+  clients, err := r.client.HGetAll(r.uidKey(uid)).Result()
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+
+  tokens = make([]string, 0, len(clients))
+  for _, token := range clients {
+    tokens = append(tokens, token)
+  }
+
+  return tokens, nil
+}
+
+func (r *redisStore) Evict(ctx context.Context, uid string, limit Limit) ([]Device, error) {
+  _, logger := log.WithCtx(ctx)
+
+  eviction, err := evictionArg(limit)
+  if err != nil {
+    return nil, err
+  }
+
+  res, err := r.runWithTokens(evictScript, uid, []string{r.uidKey(uid), r.familyKey(uid)}, r.tokenPrefix(uid),
+    eviction)
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+
+  _, evicted, err := evictResult(res, 0)
+  return evicted, err
+}
+
+func (r *redisStore) forEachNode(f func(node *redis.Client) error) error {
+  if c, ok := r.client.(*redis.ClusterClient); ok {
+    return c.ForEachMaster(f)
+  }
+  return f(r.client.(*redis.Client))
+}
+
+// unwrapKey 从 key 中去掉 prefix 及 cluster 模式下的 hash tag
+func (r *redisStore) unwrapKey(key string, prefix string) string {
+  key = strings.TrimPrefix(key, prefix)
+  if r.cluster && strings.HasPrefix(key, "{") {
+    if i := strings.Index(key, "}"); i > 0 {
+      key = key[i+1:]
+    }
+  }
+  return key
+}
+
+const scanCount = 500
+
+func scan(ctx context.Context, node *redis.Client, match string, f func(key string) error) error {
+  var cursor uint64
+  for {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+
+    keys, next, err := node.Scan(cursor, match, scanCount).Result()
+    if err != nil {
+      return err
+    }
+    for _, key := range keys {
+      if err = f(key); err != nil {
+        return err
+      }
+    }
+
+    if next == 0 {
+      return nil
+    }
+    cursor = next
+  }
+}
+
+func (r *redisStore) Reconcile(ctx context.Context) (report ReconcileReport, err error) {
+  _, logger := log.WithCtx(ctx)
+  reportMu := sync.Mutex{}
+
+  err = r.forEachNode(func(node *redis.Client) error {
+    // cluster 模式下各个节点并发执行
+    var nodeReport ReconcileReport
+
+    err := scan(ctx, node, uidK+"*", func(key string) error {
+      nodeReport.ScannedUids++
+      uid := r.unwrapKey(key, uidK)
+      res, err := r.runWithTokens(danglingRefsScript, uid, []string{key, r.familyKey(uid)}, r.tokenPrefix(uid))
+      removed, _ := res.(int64)
+      nodeReport.DanglingRefs += removed
+      return err
+    })
+    if err != nil {
+      return err
+    }
+
+    err = scan(ctx, node, tokenK+"*", func(key string) error {
+      nodeReport.ScannedTokens++
+      token := r.unwrapKey(key, tokenK)
+      values, err := r.client.HMGet(key, vUid, vClientId, vRefresh, vFamily).Result()
+      if err != nil {
+        return err
+      }
+
+      uid, _ := values[0].(string)
+      clientId, _ := values[1].(string)
+      // access token 的 refresh token 不在 uid 的索引中时，也是孤儿
+      if refresh, _ := values[2].(string); refresh != "" {
+        token = refresh
+      }
+      family, _ := values[3].(string)
+      if uid == "" {
+        // 没有 uid 的 token
+        removed, err := r.client.Del(key).Result()
+        nodeReport.OrphanTokens += removed
+        return err
+      }
+
+      removed, err := orphanTokenScript.Run(r.client, []string{key, r.uidKey(uid), r.familyKey(uid)},
+        clientId, token, family).Int64()
+      nodeReport.OrphanTokens += removed
+      return err
+    })
+    if err != nil {
+      return err
+    }
+
+    reportMu.Lock()
+    report.ScannedUids += nodeReport.ScannedUids
+    report.ScannedTokens += nodeReport.ScannedTokens
+    report.DanglingRefs += nodeReport.DanglingRefs
+    report.OrphanTokens += nodeReport.OrphanTokens
+    reportMu.Unlock()
+    return nil
+  })
+
+  return report, storeErr(logger, err)
+}
+
+func (r *redisStore) MigrateHash(ctx context.Context, isHashed func(token string) bool,
+  hash func(token string) string) (migrated int64, err error) {
+
+  _, logger := log.WithCtx(ctx)
+  mu := sync.Mutex{}
+
+  err = r.forEachNode(func(node *redis.Client) error {
+    err := scan(ctx, node, uidK+"*", func(key string) error {
+      clients, err := r.client.HGetAll(key).Result()
+      if err != nil {
+        return err
+      }
+
+      prefix := r.tokenPrefix(r.unwrapKey(key, uidK))
+      keys := []string{key}
+      args := make([]interface{}, 0)
+      for client, token := range clients {
+        if !isHashed(token) {
+          hashed := hash(token)
+          keys = append(keys, prefix+token, prefix+hashed)
+          args = append(args, client, token, hashed)
+        }
+      }
+      if len(args) == 0 {
+        return nil
+      }
+
+      n, err := migrateHashScript.Run(r.client, keys, args...).Int64()
+      mu.Lock()
+      migrated += n
+      mu.Unlock()
+      return err
+    })
+    if err != nil {
+      return err
+    }
+
+    // access token 不在 uid 的索引中，其 Value.Refresh 也需要指向 hash 之后的 refresh token
+    return scan(ctx, node, tokenK+"*", func(key string) error {
+      token := r.unwrapKey(key, tokenK)
+      refresh, err := r.client.HGet(key, vRefresh).Result()
+      if err != nil && err != redis.Nil {
+        return err
+      }
+      if isHashed(refresh) {
+        refresh = ""
+      }
+      if isHashed(token) && refresh == "" {
+        return nil
+      }
+
+      hashedRefresh := ""
+      if refresh != "" {
+        hashedRefresh = hash(refresh)
+      }
+      hashedKey := key
+      if !isHashed(token) {
+        hashedKey = r.tokenKey(hash(token))
+      }
+      n, err := migrateTokenScript.Run(r.client, []string{key, hashedKey}, refresh, hashedRefresh).Int64()
+      mu.Lock()
+      migrated += n
+      mu.Unlock()
+      return err
+    })
+  })
+
+  return migrated, storeErr(logger, err)
+}
+
+// SupportsEviction 淘汰在脚本中执行，只支持内置的策略
+func (r *redisStore) SupportsEviction(e EvictionStrategy) bool {
+  _, ok := e.(scriptEviction)
+  return ok
+}
+
+func (r *redisStore) Rotate(ctx context.Context, token string, newToken string, limit Limit) (*Value, error) {
+  _, logger := log.WithCtx(ctx)
+
+  // uidKey、familyKey 及 notBeforeKey 由 uid 得到，先读取 token 的 uid
+  tokenKey := r.tokenKey(token)
+  uid, err := r.client.HGet(tokenKey, vUid).Result()
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+  if uid == "" {
+    return nil, ErrNotFound
+  }
+
+  res, err := r.runWithTokens(rotateScript, uid,
+    []string{tokenKey, r.tokenKey(newToken), r.uidKey(uid), r.familyKey(uid), r.notBeforeKey(uid)},
+    r.tokenPrefix(uid), uid, token, newToken, limit.TTL.Milliseconds(), limit.ReuseWindow.Milliseconds(),
+    unixMs(limit.NotBefore))
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+
+  ret := scriptStrings(res)
+  if len(ret) == 0 {
+    return nil, StoreUnavailable(fmt.Errorf("unexpected result of rotate script: %v", res))
+  }
+
+  switch ret[0] {
+  case rotateNotFound:
+    return nil, ErrNotFound
+  case rotateNotRefresh:
+    return nil, ErrNotRefreshToken
+  case rotateReused:
+    return nil, ErrRefreshReused
+  }
+
+  m := make(map[string]string, len(ret)/2)
+  for i := 1; i+1 < len(ret); i += 2 {
+    m[ret[i]] = ret[i+1]
+  }
+  return fromMap(m), nil
+}
+
+const revokedK = "revoked:"
+
+func (r *redisStore) Revoke(ctx context.Context, id string, ttl time.Duration) error {
+  _, logger := log.WithCtx(ctx)
+  err := r.client.Set(revokedK+id, 1, ttl).Err()
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) IsRevoked(ctx context.Context, id string) (bool, error) {
+  _, logger := log.WithCtx(ctx)
+  n, err := r.client.Exists(revokedK + id).Result()
+
+  return n == 1, storeErr(logger, err)
+}
+
+const tombstoneK = "tombstone:"
+
+// tombstoneKey 与 tokenKey 在同一个 slot 中
+func (r *redisStore) tombstoneKey(token string) string {
+  return tombstoneK + r.tokenTag(token) + token
+}
+
+func (r *redisStore) SetTombstones(ctx context.Context, tombstones map[string]*Tombstone, ttl time.Duration) error {
+  _, logger := log.WithCtx(ctx)
+
+  _, err := r.client.Pipelined(func(pipeliner redis.Pipeliner) error {
+    for token, t := range tombstones {
+      data, err := json.Marshal(t)
+      if err != nil {
+        return err
+      }
+      pipeliner.Set(r.tombstoneKey(token), data, ttl)
+    }
+    return nil
+  })
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) Tombstone(ctx context.Context, token string) (*Tombstone, error) {
+  _, logger := log.WithCtx(ctx)
+
+  data, err := r.client.Get(r.tombstoneKey(token)).Bytes()
+  if err = storeErr(logger, err); err != nil {
+    return nil, err
+  }
+
+  t := &Tombstone{}
+  if err = json.Unmarshal(data, t); err != nil {
+    return nil, StoreUnavailable(err)
+  }
+  return t, nil
+}
+
+const (
+  notBeforeK       = "notBefore:"
+  globalNotBeforeK = "notBefore"
+)
+
+// notBeforeKey 与 uidKey 在同一个 slot 中，uid 为 "" 时为全局的
+func (r *redisStore) notBeforeKey(uid string) string {
+  if uid == "" {
+    return globalNotBeforeK
+  }
+  if !r.cluster {
+    return notBeforeK + uid
+  }
+  return notBeforeK + "{" + slotTag(uid) + "}" + uid
+}
+
+func (r *redisStore) SetNotBefore(ctx context.Context, uid string, t time.Time, ttl time.Duration) error {
+  _, logger := log.WithCtx(ctx)
+  err := r.client.Set(r.notBeforeKey(uid), unixMs(t), ttl).Err()
+
+  return storeErr(logger, err)
+}
+
+func (r *redisStore) NotBefore(ctx context.Context, uid string) (time.Time, error) {
+  _, logger := log.WithCtx(ctx)
+
+  ms, err := r.client.Get(r.notBeforeKey(uid)).Int64()
+  if err == redis.Nil {
+    return time.Time{}, nil
+  }
+  if err = storeErr(logger, err); err != nil {
+    return time.Time{}, err
+  }
+  return fromMs(ms), nil
+}
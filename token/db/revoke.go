@@ -0,0 +1,68 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * 不依赖存储的 token(比如签名的 token)，注销时只能在存储中记录其 id，直到它本身过期
+ */
+
+// Revoker 支持记录注销的 Store 实现此接口
+type Revoker interface {
+  Revoke(ctx context.Context, id string, ttl time.Duration) error
+  IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+var ErrRevokeNotSupported = errors.New("token db: the store does not support revoke")
+
+func (t *timeoutStore) Revoke(ctx context.Context, id string, ttl time.Duration) error {
+  r, ok := t.Store.(Revoker)
+  if !ok {
+    return ErrRevokeNotSupported
+  }
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return r.Revoke(ctx, id, ttl)
+  })
+}
+
+func (t *timeoutStore) IsRevoked(ctx context.Context, id string) (bool, error) {
+  r, ok := t.Store.(Revoker)
+  if !ok {
+    return false, ErrRevokeNotSupported
+  }
+
+  var revoked bool
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    revoked, err = r.IsRevoked(ctx, id)
+    return
+  })
+  if err != nil {
+    return false, err
+  }
+  return revoked, nil
+}
+
+// RevokeWithErr 记录 id 已注销，ttl 应不小于 id 对应的 token 剩余的有效期
+func RevokeWithErr(ctx context.Context, id string, ttl time.Duration) error {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db")
+
+  if ttl <= 0 {
+    return nil
+  }
+
+  log.Info(fmt.Sprintf("revoke id(%s) for %s", id, ttl))
+  return currentStore().(Revoker).Revoke(ctx, id, ttl)
+}
+
+func IsRevokedWithErr(ctx context.Context, id string) (bool, error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.PushPrefix("token db")
+
+  return currentStore().(Revoker).IsRevoked(ctx, id)
+}
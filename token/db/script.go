@@ -0,0 +1,458 @@
+package db
+
+import "github.com/go-redis/redis"
+
+/**
+ * 淘汰、OverWrite、SetOrUseOld 都在 redis 服务端以 Lua 脚本执行，每一个操作都是一次原子的请求，
+ * 不再需要 WATCH 事务的重试及事后补偿。
+ *
+ * 脚本访问的 key 都由 KEYS 传入(redis cluster 据此定位 slot，不能在脚本中拼接 key)。依赖于存储中数据的 key:
+ *   uid 索引中各个 token 的 key，由 redisStore.runWithTokens 先读取 uid 的索引，再作为 KEYS 传入，脚本中由 declareTokens
+ *   得到 token ---> key。读取之后 uid 的索引中又有了新的 token 时，脚本在修改之前返回 {'retry'}，由 runWithTokens 重新执行；
+ *   token 的 uid 对应的 key，由调用者先读取 token 的 uid，脚本中再检查一次。
+ * familyKey 与 uidKey 相对应，记录 uid 的各个 ClientId 当前的 family，见 family.go
+ */
+
+// tokenKeysLua: declareTokens(tokenPrefix, first) KEYS[first] 及其后都是 tokenPrefix .. token，记录到 tokenKeys 中;
+// undeclared(uidKey) uid 的索引中是否有没有声明的 token
+const tokenKeysLua = `
+local tokenKeys = {}
+local function declareTokens(tokenPrefix, first)
+  for i = first, #KEYS do
+    tokenKeys[string.sub(KEYS[i], #tokenPrefix + 1)] = KEYS[i]
+  end
+end
+
+local function undeclared(uidKey)
+  for _, token in ipairs(redis.call('HVALS', uidKey)) do
+    if not tokenKeys[token] then
+      return true
+    end
+  end
+  return false
+end
+`
+
+// msLua: ms(t) issuedAt、notBefore 都是 unix 毫秒，之前写入的为 unix 秒(小于 msThreshold)，转换为毫秒；没有的为 0
+const msLua = `
+local function ms(t)
+  t = tonumber(t) or 0
+  if t > 0 and t < 100000000000 then
+    return t * 1000
+  end
+  return t
+end
+`
+
+// evictLua: evict(uidKey, familyKey, eviction, incomingClientId, incomingType, incomingExclusive)，需要 tokenKeysLua，
+// uid 索引中的 token 都已声明
+// eviction 为 evictionArg 生成的 json: {min, max, devices, strategy}，与 eviction.go 中的 evictionVictims 相同:
+// uid 的 token(不包括 incomingClientId)中，与 incomingExclusive 在同一互斥分组的都淘汰，其余的按 clientType 分组
+// (没有在 devices 中的类型为一组，使用 min、max)，每一组由 strategy 选出淘汰的 token，不存在的 token 最先淘汰。
+// incomingClientId 为 '' 时表示没有写入。
+// 返回淘汰的 token，每一个为 {clientId, token, clientType, latestTime, issuedAt, exclusive}；拒绝写入时返回 nil
+const evictLua = tokenKeysLua + msLua + `
+local function pick(list, n, gmin, gmax, strategy, incoming, incomingType)
+  if n < gmax then
+    return {}
+  end
+  if strategy == '` + EvictReject + `' then
+    if incoming then
+      return nil
+    end
+    return {}
+  end
+
+  local candidates = list
+  if strategy == '` + EvictSameType + `' and incoming then
+    candidates = {}
+    for _, d in ipairs(list) do
+      if d[3] == incomingType then
+        table.insert(candidates, d)
+      end
+    end
+  end
+
+  local key = 7
+  if strategy == '` + EvictFIFO + `' then
+    key = 8
+  end
+  table.sort(candidates, function(a, b)
+    if a[key] ~= b[key] then
+      return a[key] < b[key]
+    end
+    return a[1] < b[1]
+  end)
+
+  local ret = {}
+  for _, d in ipairs(candidates) do
+    if n <= gmin then
+      break
+    end
+    table.insert(ret, d)
+    n = n - 1
+  end
+  return ret
+end
+
+local function evict(uidKey, familyKey, eviction, incomingClientId, incomingType, incomingExclusive)
+  eviction = cjson.decode(eviction)
+  local devices = eviction.devices
+  local function groupOf(clientType)
+    if clientType ~= '' and devices[clientType] then
+      return clientType
+    end
+    return ''
+  end
+
+  local victims = {}
+  local groups = {}
+  local clients = redis.call('HGETALL', uidKey)
+  for i = 1, #clients, 2 do
+    if clients[i] ~= incomingClientId then
+      local v = redis.call('HMGET', tokenKeys[clients[i+1]], '` + vClientType + `', '` + vLatestTime + `',
+        '` + vIssuedAt + `', '` + vExclusive + `')
+      local d = {clients[i], clients[i+1], v[1] or '', v[2] or '', v[3] or '', v[4] or '',
+        tonumber(v[2]) or -math.huge, tonumber(v[3]) and ms(v[3]) or -math.huge}
+      if incomingExclusive ~= '' and d[6] == incomingExclusive then
+        table.insert(victims, d)
+      else
+        local group = groupOf(d[3])
+        groups[group] = groups[group] or {}
+        table.insert(groups[group], d)
+      end
+    end
+  end
+
+  local incomingGroup = nil
+  if incomingClientId ~= '' then
+    incomingGroup = groupOf(incomingType)
+    groups[incomingGroup] = groups[incomingGroup] or {}
+  end
+
+  for group, list in pairs(groups) do
+    local gmin, gmax = eviction.min, eviction.max
+    if group ~= '' then
+      gmin, gmax = devices[group].min, devices[group].max
+    end
+    local incoming = group == incomingGroup
+    local n = #list
+    if incoming then
+      n = n + 1
+    end
+
+    local picked = pick(list, n, gmin, gmax, eviction.strategy, incoming, incomingType)
+    if not picked then
+      return nil
+    end
+    for _, d in ipairs(picked) do
+      table.insert(victims, d)
+    end
+  end
+
+  for _, d in ipairs(victims) do
+    redis.call('DEL', tokenKeys[d[2]])
+    redis.call('HDEL', uidKey, d[1])
+    redis.call('HDEL', familyKey, d[1])
+  end
+  return victims
+end
+
+-- evicted 脚本的返回值: {status, ...}，其后为淘汰的 token
+local function evicted(ret, victims)
+  for _, d in ipairs(victims) do
+    for i = 1, 6 do
+      table.insert(ret, d[i])
+    end
+  end
+  return ret
+end
+`
+
+// KEYS: uidKey, familyKey, uid 索引中的 tokenKey...
+// ARGV: tokenPrefix, eviction
+// 返回 {'ok', 淘汰的 token...}
+var evictScript = redis.NewScript(evictLua + `
+declareTokens(ARGV[1], 3)
+if undeclared(KEYS[1]) then
+  return {'` + scriptRetry + `'}
+end
+return evicted({'` + evictOk + `'}, evict(KEYS[1], KEYS[2], ARGV[2], '', '', ''))
+`)
+
+// setFamilyLua: setFamily(familyKey, clientId, family)
+const setFamilyLua = `
+local function setFamily(familyKey, clientId, family)
+  if family and family ~= '' then
+    redis.call('HSET', familyKey, clientId, family)
+  else
+    redis.call('HDEL', familyKey, clientId)
+  end
+end
+`
+
+// KEYS: uidKey, tokenKey, familyKey, uid 索引中的 tokenKey...
+// ARGV: tokenPrefix, clientId, token, ttl(ms), eviction, clientType, exclusive, value fields...
+// 返回 {'ok', 淘汰的 token...}，拒绝写入时返回 {'rejected'}
+var overWriteScript = redis.NewScript(evictLua + setFamilyLua + `
+declareTokens(ARGV[1], 4)
+if undeclared(KEYS[1]) then
+  return {'` + scriptRetry + `'}
+end
+
+-- 先淘汰
+local victims = evict(KEYS[1], KEYS[3], ARGV[5], ARGV[2], ARGV[6], ARGV[7])
+if not victims then
+  return {'` + evictRejected + `'}
+end
+
+local old = redis.call('HGET', KEYS[1], ARGV[2])
+-- 先删除旧的token
+if old then
+  redis.call('DEL', tokenKeys[old])
+end
+
+-- 然后写入新的
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+redis.call('HMSET', KEYS[2], unpack(ARGV, 8))
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+setFamily(KEYS[3], ARGV[2], redis.call('HGET', KEYS[2], '` + vFamily + `'))
+
+return evicted({'` + evictOk + `'}, victims)
+`)
+
+// KEYS: uidKey, familyKey, notBeforeKey, tokenKey, uid 索引中的 tokenKey...
+// ARGV: tokenPrefix, clientId, token, ttl(ms), eviction, clientType, exclusive, latestTime,
+//   minIssuedAt(unix 毫秒，0 表示不限制), 全局的 notBefore(unix 毫秒，0: 没有), value fields...
+// 返回 {'ok', 实际使用的 token, 淘汰的 token...}，拒绝写入时返回 {'rejected'}
+var setOrUseOldScript = redis.NewScript(evictLua + setFamilyLua + `
+declareTokens(ARGV[1], 4)
+if undeclared(KEYS[1]) then
+  return {'` + scriptRetry + `'}
+end
+
+-- 先淘汰
+local victims = evict(KEYS[1], KEYS[2], ARGV[5], ARGV[2], ARGV[6], ARGV[7])
+if not victims then
+  return {'` + evictRejected + `'}
+end
+
+local ttl = tonumber(ARGV[4])
+local minIssuedAt = tonumber(ARGV[9])
+local notBefore = math.max(tonumber(ARGV[10]), ms(redis.call('GET', KEYS[3])))
+local token = redis.call('HGET', KEYS[1], ARGV[2])
+if token then
+  local v = redis.call('HMGET', tokenKeys[token], '` + vUid + `', '` + vIssuedAt + `')
+  local issuedAt = ms(v[2])
+  if not v[1] or (minIssuedAt > 0 and issuedAt > 0 and issuedAt <= minIssuedAt) or
+    (notBefore > 0 and issuedAt <= notBefore) then
+    -- 旧值已经过期、超过登录的最长时间或者已经被 NotBefore 撤销，不再使用
+    redis.call('DEL', tokenKeys[token])
+    token = false
+  elseif minIssuedAt > 0 and issuedAt > 0 then
+    ttl = math.min(ttl, issuedAt - minIssuedAt)
+  end
+end
+
+if token then
+  -- 有旧值，使用旧值
+  redis.call('HMSET', tokenKeys[token], '` + vLatestTime + `', ARGV[8], '` + vExclusive + `', ARGV[7])
+else
+  token = ARGV[3]
+  redis.call('HSET', KEYS[1], ARGV[2], token)
+  redis.call('HMSET', KEYS[4], unpack(ARGV, 11))
+  setFamily(KEYS[2], ARGV[2], redis.call('HGET', KEYS[4], '` + vFamily + `'))
+end
+redis.call('PEXPIRE', tokenKeys[token], ttl)
+
+return evicted({'` + evictOk + `', token}, victims)
+`)
+
+// KEYS: uidKey, familyKey, uid 索引中的 tokenKey...
+// ARGV: tokenPrefix
+// 删除 uid 索引中指向不存在 token 的项，及 uid 索引中已经没有的 family，返回删除的个数。
+// 没有声明的 token 是读取索引之后新写入的，不检查
+var danglingRefsScript = redis.NewScript(tokenKeysLua + `
+declareTokens(ARGV[1], 3)
+local clients = redis.call('HGETALL', KEYS[1])
+local removed = 0
+for i = 1, #clients, 2 do
+  local tokenKey = tokenKeys[clients[i+1]]
+  if tokenKey and redis.call('EXISTS', tokenKey) == 0 then
+    redis.call('HDEL', KEYS[1], clients[i])
+    removed = removed + 1
+  end
+end
+
+local families = redis.call('HKEYS', KEYS[2])
+for _, client in ipairs(families) do
+  if redis.call('HEXISTS', KEYS[1], client) == 0 then
+    redis.call('HDEL', KEYS[2], client)
+    removed = removed + 1
+  end
+end
+return removed
+`)
+
+// KEYS: tokenKey, uidKey, familyKey
+// ARGV: clientId, token, family
+// 有 family 的 token，family 不是 clientId 当前的 family 时；没有 family 的 token，uid 的索引没有指向 token 时，
+// 删除 token，返回删除的个数
+var orphanTokenScript = redis.NewScript(`
+local current
+if ARGV[3] ~= '' then
+  current = redis.call('HGET', KEYS[3], ARGV[1]) == ARGV[3]
+else
+  current = redis.call('HGET', KEYS[2], ARGV[1]) == ARGV[2]
+end
+if not current then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// KEYS: tokenKey
+// ARGV: ttl(ms), latestTime
+// token 存在时刷新其 TTL 及 latestTime，返回是否存在。不存在时(比如已经删除)不能写入，否则会生成没有 TTL 的 token
+var expireAndSetLatestTimeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+redis.call('HSET', KEYS[1], '` + vLatestTime + `', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+// KEYS: tokenKey, familyKey, notBeforeKey
+// ARGV: uid, minIssuedAt(unix 毫秒，0: 不限制), 全局的 notBefore(unix 毫秒，0: 没有)
+// familyKey 及 notBeforeKey 为调用者先读取的 token 的 uid 的，token 的 uid 不是 ARGV[1] 时(比如已经删除)返回 nil。
+// 返回 token 的 uid。issuedAt 早于 minIssuedAt、不晚于 uid 的或者全局的 notBefore(没有 issuedAt 的视为更早)
+// 或者 family 已经撤销的 token 返回 nil 并删除；
+// refresh token 只能用于换取 access token，返回 nil 但保留其数据，已经轮换过的同样保留，用于发现重复使用
+var uidScript = redis.NewScript(msLua + `
+local v = redis.call('HMGET', KEYS[1], '` + vUid + `', '` + vClientId + `', '` + vFamily + `', '` + vRotated + `', '` + vIssuedAt + `', '` + vRefreshOnly + `')
+if v[1] ~= ARGV[1] then
+  return false
+end
+local issuedAt = ms(v[5])
+if issuedAt > 0 and issuedAt < tonumber(ARGV[2]) then
+  redis.call('DEL', KEYS[1])
+  return false
+end
+local notBefore = math.max(tonumber(ARGV[3]), ms(redis.call('GET', KEYS[3])))
+if notBefore > 0 and issuedAt <= notBefore then
+  redis.call('DEL', KEYS[1])
+  return false
+end
+if v[4] == 'true' or v[6] == 'true' then
+  return false
+end
+if v[3] and v[3] ~= '' and redis.call('HGET', KEYS[2], v[2]) ~= v[3] then
+  redis.call('DEL', KEYS[1])
+  return false
+end
+return v[1]
+`)
+
+// KEYS: tokenKey, new tokenKey, uidKey, familyKey, notBeforeKey, uid 索引中的 tokenKey...
+// ARGV: tokenPrefix, uid, token, new token, ttl(ms), reuseWindow(ms), 全局的 notBefore(unix 毫秒，0: 没有)
+// uidKey、familyKey 及 notBeforeKey 为调用者先读取的 token 的 uid 的，token 的 uid 不是 ARGV[2] 时返回 notfound
+// 返回 {状态} 或者 {'ok', new token 的 value fields...}，状态见 rotateStatus
+var rotateScript = redis.NewScript(tokenKeysLua + msLua + `
+declareTokens(ARGV[1], 6)
+local v = redis.call('HMGET', KEYS[1], '` + vUid + `', '` + vClientId + `', '` + vFamily + `', '` + vRefreshOnly + `', '` + vRotated + `', '` + vIssuedAt + `')
+if not v[1] or v[1] ~= ARGV[2] then
+  return {'` + rotateNotFound + `'}
+end
+if v[4] ~= 'true' or not v[3] or v[3] == '' then
+  return {'` + rotateNotRefresh + `'}
+end
+
+local clientId = v[2]
+local current = redis.call('HGET', KEYS[3], clientId)
+if current and not tokenKeys[current] then
+  return {'` + scriptRetry + `'}
+end
+
+local issuedAt = ms(v[6])
+local notBefore = math.max(tonumber(ARGV[7]), ms(redis.call('GET', KEYS[5])))
+if notBefore > 0 and issuedAt <= notBefore then
+  redis.call('DEL', KEYS[1])
+  return {'` + rotateNotFound + `'}
+end
+
+-- family 已经撤销或者被新的登录替换
+if redis.call('HGET', KEYS[4], clientId) ~= v[3] then
+  return {'` + rotateNotFound + `'}
+end
+
+if v[5] == 'true' or current ~= ARGV[3] then
+  -- 重复使用，撤销整个 family
+  if current then
+    redis.call('DEL', tokenKeys[current])
+    redis.call('HDEL', KEYS[3], clientId)
+  end
+  redis.call('HDEL', KEYS[4], clientId)
+  return {'` + rotateReused + `'}
+end
+
+local fields = redis.call('HGETALL', KEYS[1])
+redis.call('HMSET', KEYS[2], unpack(fields))
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+redis.call('HSET', KEYS[1], '` + vRotated + `', 'true')
+local window = tonumber(ARGV[6])
+local pttl = redis.call('PTTL', KEYS[1])
+if window <= 0 then
+  redis.call('DEL', KEYS[1])
+elseif pttl < 0 or pttl > window then
+  redis.call('PEXPIRE', KEYS[1], window)
+end
+redis.call('HSET', KEYS[3], clientId, ARGV[4])
+
+local ret = {'ok'}
+for _, f in ipairs(fields) do
+  ret[#ret+1] = f
+end
+return ret
+`)
+
+// KEYS: uidKey, [old tokenKey, new tokenKey]...
+// ARGV: [clientId, old token, new token]...
+// 把 uid 索引中的 old token 替换为 new token，并重命名 token 的 key(保留 TTL)，返回替换的个数
+var migrateHashScript = redis.NewScript(`
+local n = 0
+local k = 2
+for i = 1, #ARGV, 3 do
+  if redis.call('HGET', KEYS[1], ARGV[i]) == ARGV[i+1] then
+    if redis.call('EXISTS', KEYS[k]) == 1 then
+      redis.call('RENAME', KEYS[k], KEYS[k+1])
+    end
+    redis.call('HSET', KEYS[1], ARGV[i], ARGV[i+2])
+    n = n + 1
+  end
+  k = k + 2
+end
+return n
+`)
+
+// KEYS: tokenKey, hashed tokenKey
+// ARGV: refresh token, hashed refresh token
+// Value.Refresh 为 ARGV[1] 时替换为 ARGV[2](ARGV[1] 为 "" 时不替换)，然后把 tokenKey 重命名为 hashed tokenKey(保留 TTL)，
+// 返回是否重命名了
+var migrateTokenScript = redis.NewScript(`
+if ARGV[1] ~= '' and redis.call('HGET', KEYS[1], '` + vRefresh + `') == ARGV[1] then
+  redis.call('HSET', KEYS[1], '` + vRefresh + `', ARGV[2])
+end
+if KEYS[1] ~= KEYS[2] and redis.call('EXISTS', KEYS[1]) == 1 then
+  redis.call('RENAME', KEYS[1], KEYS[2])
+  return 1
+end
+return 0
+`)
+
+func mapArgs(args []interface{}, m map[string]interface{}) []interface{} {
+  for k, v := range m {
+    args = append(args, k, v)
+  }
+  return args
+}
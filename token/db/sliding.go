@@ -0,0 +1,74 @@
+package db
+
+import (
+  "sync"
+  "time"
+)
+
+/**
+ * 滑动过期：token 每次通过验证时刷新 TTL 及 LatestTime，活跃的用户不会因为 MaxTTL 而需要重新登录。
+ *
+ * 为了不在每个请求上都写存储，同一个 token 在 Sliding.IntervalMinutes 内只刷新一次。
+ * 刷新的记录只在本进程中，多个进程时每个进程各自最多刷新一次；记录的 token 数超过 Sliding.CacheSize 时丢弃最久的，
+ * 被丢弃的 token 下次请求会再刷新一次
+ */
+
+// slidCache token ---> 最近一次刷新的时间，最多 Sliding.CacheSize 个，超过 interval 的自动清除，见 lru.go
+type slidCache struct {
+  mu     sync.Mutex
+  tokens *lruCache
+}
+
+var slidTokens = &slidCache{tokens: newLRUCache(func() int64 {
+  return confValue.Sliding.CacheSize
+}, slideInterval)}
+
+func slideInterval() time.Duration {
+  return time.Duration(confValue.Sliding.IntervalMinutes) * time.Minute
+}
+
+// allow 没有在 interval 内刷新过时，记录 now 并返回 true
+func (c *slidCache) allow(token string, now time.Time) bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if _, _, ok := c.tokens.get(token, now); ok {
+    return false
+  }
+  c.tokens.add(token, nil, now)
+  return true
+}
+
+func (c *slidCache) del(token string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.tokens.del(token)
+}
+
+// SlideWithErr 按 Sliding 的配置刷新 TTL 及 LatestTime，返回是否刷新了。
+// access token 的有效期固定，不刷新
+func (db *DB) SlideWithErr() (bool, error) {
+  if !confValue.Sliding.Enabled {
+    return false, nil
+  }
+
+  now := time.Now()
+  if !slidTokens.allow(db.key, now) {
+    return false, nil
+  }
+
+  value, err := db.ValueWithErr()
+  if err == nil && value.Refresh != "" {
+    return false, nil
+  }
+  if err == nil {
+    err = db.RefreshTTLAndLastTimeWithErr(now)
+  }
+  if err != nil {
+    // 下次请求再试
+    slidTokens.del(db.key)
+    return false, err
+  }
+
+  return true, nil
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+  "testing"
+  "time"
+)
+
+func TestSlidCache(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Sliding.IntervalMinutes = 10
+  confValue.Sliding.CacheSize = 0
+  slidTokens.tokens.reset()
+  t.Cleanup(slidTokens.tokens.reset)
+
+  now := time.Now()
+  if !slidTokens.allow("t1", now) {
+    t.Fatal("first")
+  }
+  if slidTokens.allow("t1", now.Add(time.Minute)) {
+    t.Fatal("in the interval")
+  }
+  if !slidTokens.allow("t1", now.Add(slideInterval())) {
+    t.Fatal("after the interval")
+  }
+
+  confValue.Sliding.CacheSize = 1
+  slidTokens.allow("t2", now.Add(slideInterval()))
+  if !slidTokens.allow("t1", now.Add(slideInterval())) {
+    t.Fatal("t1 is not dropped")
+  }
+}
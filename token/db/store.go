@@ -0,0 +1,186 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "github.com/go-redis/redis"
+  "net"
+  "strconv"
+  "sync"
+  "time"
+)
+
+/**
+ * Store 是 token 数据的存储后端，DB 的所有读写都经由 Store 完成。
+ *
+ * 实现者需要保证与 redis 实现相同的语义：
+ *   1、token ---> Value，token 数据有 TTL，过期后视为不存在
+ *   2、uid ---> {ClientId: token, ...}，同一个 uid 的同一个 ClientId 只有一个 token
+ *   3、以 token 数据作为判断的标准，写的时候后写，删的时候先删
+ *
+ * 数据不存在时返回 ErrNotFound，存储本身出错时返回 StoreUnavailable(err)。
+ * ctx 的超时与取消已由外层统一处理(见 timeout.go)，实现者可以不再处理
+ */
+
+type Store interface {
+  Value(ctx context.Context, token string) (*Value, error)
+
+  // Uid token 不存在或者没有 uid 时，返回 ErrNotFound，并清除这个 token 的数据。
+  // Value.RefreshOnly 的 token 只能用于换取 access token(见 family.go)，同样返回 ErrNotFound，但不清除其数据。
+  // minIssuedAt 不为零值时，Value.IssuedAt 早于 minIssuedAt 的 token 已经过期，同样清除其数据。
+  // notBefore 为全局的 NotBefore，实现了 NotBeforer 的 Store 同时检查 uid 的 NotBefore，见 notbefore.go
+  Uid(ctx context.Context, token string, minIssuedAt time.Time, notBefore time.Time) (uid string, err error)
+
+  Exists(ctx context.Context, token string) (bool, error)
+
+  TTL(ctx context.Context, token string) (time.Duration, error)
+
+  Expire(ctx context.Context, token string, ttl time.Duration) error
+
+  // ExpireAndSetLatestTime 同时刷新 TTL 与 Value.LatestTime，token 不存在时不写入。整个操作必须是原子的
+  ExpireAndSetLatestTime(ctx context.Context, token string, ttl time.Duration, latestTime time.Time) error
+
+  // OverWrite 先按 limit 淘汰 value.ClientId 之外的 token，然后写入 token ---> value，并删除 value.ClientId
+  // 原有的 token。返回淘汰的 token，淘汰策略拒绝写入时返回 ErrTooManyDevices。整个操作必须是原子的
+  OverWrite(ctx context.Context, token string, value *Value, limit Limit) (evicted []Device, err error)
+
+  // SetOrUseOld 先与 OverWrite 一样淘汰，然后 value.ClientId 已有有效的 token 时，使用原有 token 并更新其
+  // LatestTime 及 Exclusive，否则写入 token ---> value。返回实际使用的 token 及淘汰的 token。整个操作必须是原子的
+  SetOrUseOld(ctx context.Context, token string, value *Value, limit Limit) (realToken string, evicted []Device, err error)
+
+  // Del 删除 token 及其在 uid 中的索引
+  Del(ctx context.Context, token string, value *Value) error
+
+  // DelClientId 删除 uid 在 clientId 上的 token，并返回被删除的 token
+  DelClientId(ctx context.Context, uid string, clientId string) (token string, err error)
+
+  DelAll(ctx context.Context, uid string) error
+
+  Find(ctx context.Context, uid string, clientId string) (token string, err error)
+
+  FindAll(ctx context.Context, uid string) (tokens []string, err error)
+
+  // Evict uid 的 token 按 Value.ClientType 分组，每一组的 token 数达到其 Devices.Max 时，由 limit.Eviction
+  // 选出这一组中淘汰的 token，见 Limit.devicesOf 及 eviction.go。返回淘汰的 token。整个操作必须是原子的
+  Evict(ctx context.Context, uid string, limit Limit) (evicted []Device, err error)
+}
+
+// Slotter 需要在 token 中编码定位信息的 Store 实现此接口，比如 redis cluster 需要编码 slot 的 hash tag
+type Slotter interface {
+  SlotToken(uid string, token string) string
+}
+
+// SlotToken 生成 uid 的新 token 时，需要使用此函数处理，使 token 满足当前 Store 的格式要求
+func SlotToken(uid string, token string) string {
+  if s, ok := currentStore().(Slotter); ok {
+    return s.SlotToken(uid, token)
+  }
+  return token
+}
+
+// Limit 写入及淘汰时需要遵守的限制
+type Limit struct {
+  // 写入的 token 的有效期
+  TTL time.Duration
+  // 没有在 Devices 中的 ClientType 共用此设备数限制
+  MinDevices int64
+  MaxDevices int64
+  // 各个 ClientType 单独的设备数限制，见 policy.go
+  Devices map[string]Devices
+  // 设备数达到限制时的淘汰策略，nil 时按 LatestTime 淘汰，见 eviction.go
+  Eviction EvictionStrategy
+  // 零值表示不限制。Value.IssuedAt 早于此时间的 token 已经过期，使用原有 token 时其 TTL 也不能超过
+  // IssuedAt - MinIssuedAt，见 lifetime.go
+  MinIssuedAt time.Time
+  // 只用于 Rotate：轮换后旧的 refresh token 保留的时间，用于发现重复使用，0 时立即删除，见 family.go
+  ReuseWindow time.Duration
+  // 只用于 Rotate 及 SetOrUseOld：全局的 NotBefore，与 Uid 一样同时检查 uid 的 NotBefore，见 notbefore.go。
+  // SetOrUseOld 中不晚于 NotBefore 签发的原有 token 与过期的相同，不再使用
+  NotBefore time.Time
+}
+
+// Devices 设备数达到 Max 时，淘汰到剩余不超过 Min 个
+type Devices struct {
+  Min int64 `json:"min"`
+  Max int64 `json:"max"`
+}
+
+// devicesOf clientType 的 token 所在的淘汰分组及其设备数限制，没有单独限制的类型都在 "" 分组中
+func (l Limit) devicesOf(clientType string) (group string, d Devices) {
+  if d, ok := l.Devices[clientType]; ok && clientType != "" {
+    return clientType, d
+  }
+  return "", Devices{Min: l.MinDevices, Max: l.MaxDevices}
+}
+
+var (
+  store   Store
+  storeMu sync.Mutex
+)
+
+// SetStore 替换配置中指定的存储，应在使用 token 之前调用。测试中可注入 NewMemoryStore()。
+// s 不能执行 SetEviction 设置的策略时 panic，见 eviction.go
+func SetStore(s Store) {
+  if !supportsEviction(s, customEviction()) {
+    panic(fmt.Errorf("token db: set store, %w", ErrEvictionNotSupported))
+  }
+
+  storeMu.Lock()
+  defer storeMu.Unlock()
+  store = withTimeout(s)
+  storeBreaker.reset()
+  recentTokens.reset()
+  globalNotBefore.reset()
+}
+
+func currentStore() Store {
+  storeMu.Lock()
+  defer storeMu.Unlock()
+
+  // 配置在 init 之后才读取，所以默认的 store 需要延迟创建
+  if store == nil {
+    switch confValue.Store {
+    case memoryStoreName:
+      store = NewMemoryStore()
+    case redisStoreName, "":
+      store = NewRedisStore(newRedisClient())
+    case redisClusterStoreName:
+      store = NewRedisClusterStore(newClusterClient())
+    default:
+      panic(fmt.Sprintf("token db: unknown store(%s), must be one of %s, %s, %s",
+        confValue.Store, redisStoreName, redisClusterStoreName, memoryStoreName))
+    }
+    store = withTimeout(store)
+  }
+  return store
+}
+
+// newRedisClient 与 rediscache.Get 的连接参数相同，但读写的超时按 Timeout 的配置，超时后操作真正停止(见 timeout.go)，
+// 所以不共用 rediscache 的 client；也不重试，使每个操作的时间不超过其超时
+func newRedisClient() *redis.Client {
+  conf := confValue.Redis
+  timeout := time.Duration(conf.TimeoutMs) * time.Millisecond
+  read, write := clientTimeouts(timeout)
+  return redis.NewClient(&redis.Options{
+    Addr:         net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+    DB:           conf.DBNo,
+    DialTimeout:  timeout,
+    ReadTimeout:  read,
+    WriteTimeout: write,
+    PoolTimeout:  read,
+  })
+}
+
+func newClusterClient() *redis.ClusterClient {
+  timeout := time.Duration(confValue.RedisCluster.TimeoutMs) * time.Millisecond
+  read, write := clientTimeouts(timeout)
+  return redis.NewClusterClient(&redis.ClusterOptions{
+    Addrs:        confValue.RedisCluster.Addrs,
+    Password:     confValue.RedisCluster.Password,
+    DialTimeout:  timeout,
+    ReadTimeout:  read,
+    WriteTimeout: write,
+    PoolTimeout:  read,
+    MaxRedirects: 8,
+  })
+}
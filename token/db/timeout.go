@@ -0,0 +1,252 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "time"
+)
+
+/**
+ * timeoutStore 包装任意的 Store，使所有的存储操作都遵守调用者 ctx 的超时与取消，并且按配置给每一个操作
+ * 加上超时，同时经过熔断器(见 degrade.go)。
+ *
+ * 操作在调用者的 goroutine 中执行，带有超时的 ctx 传给 Store，Store 需要在 ctx 结束时停止。
+ * go-redis(v6) 的 client 并不支持 ctx，所以 redis 的 client 按 Timeout 的配置设置其 ReadTimeout、WriteTimeout
+ * 及 PoolTimeout(见 store.go)，超时后操作由 client 自身停止并返回错误，不会在后台继续执行
+ */
+
+type timeoutStore struct {
+  Store
+}
+
+func withTimeout(s Store) Store {
+  if _, ok := s.(*timeoutStore); ok {
+    return s
+  }
+  return &timeoutStore{Store: s}
+}
+
+func readTimeout() time.Duration {
+  return time.Duration(confValue.Timeout.ReadMs) * time.Millisecond
+}
+
+func writeTimeout() time.Duration {
+  return time.Duration(confValue.Timeout.WriteMs) * time.Millisecond
+}
+
+// clientTimeouts redis client 的超时，没有配置时使用 def(连接本身的 timeout)。
+// 写操作(脚本)的返回值同样在 ReadTimeout 内读取，所以 read 不小于 write
+func clientTimeouts(def time.Duration) (read time.Duration, write time.Duration) {
+  read, write = readTimeout(), writeTimeout()
+  if read <= 0 {
+    read = def
+  }
+  if write <= 0 {
+    write = def
+  }
+  if read < write {
+    read = write
+  }
+  return
+}
+
+// do 调用者的 ctx 结束(比如客户端断开)不是存储的问题，返回 ctx.Err()，也不计入熔断
+func do(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  if !storeBreaker.allow() {
+    return StoreUnavailable(ErrCircuitOpen)
+  }
+
+  err := doWithTimeout(ctx, timeout, f)
+  if ctx.Err() == nil {
+    storeBreaker.record(err)
+  }
+  return err
+}
+
+// doWithTimeout 调用者的 ctx 结束时返回 ctx.Err()；存储出错时 timeout 已经到期的，返回 StoreUnavailable(ctx.Err())
+func doWithTimeout(parent context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+  if err := parent.Err(); err != nil {
+    return err
+  }
+
+  ctx := parent
+  if timeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(parent, timeout)
+    defer cancel()
+  }
+
+  err := f(ctx)
+  if err == nil {
+    return nil
+  }
+  if parentErr := parent.Err(); parentErr != nil {
+    return parentErr
+  }
+  ctxErr := ctx.Err()
+  if ctxErr != nil && (errors.Is(err, ErrStoreUnavailable) || errors.Is(err, ctxErr)) {
+    return StoreUnavailable(ctxErr)
+  }
+  return err
+}
+
+func (t *timeoutStore) SlotToken(uid string, token string) string {
+  if s, ok := t.Store.(Slotter); ok {
+    return s.SlotToken(uid, token)
+  }
+  return token
+}
+
+func (t *timeoutStore) Value(ctx context.Context, token string) (*Value, error) {
+  var value *Value
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    value, err = t.Store.Value(ctx, token)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return value, nil
+}
+
+func (t *timeoutStore) Uid(ctx context.Context, token string, minIssuedAt time.Time,
+  notBefore time.Time) (string, error) {
+
+  var uid string
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    uid, err = t.Store.Uid(ctx, token, minIssuedAt, notBefore)
+    return
+  })
+  if err != nil {
+    return "", err
+  }
+  return uid, nil
+}
+
+func (t *timeoutStore) Exists(ctx context.Context, token string) (bool, error) {
+  var ok bool
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    ok, err = t.Store.Exists(ctx, token)
+    return
+  })
+  if err != nil {
+    return false, err
+  }
+  return ok, nil
+}
+
+func (t *timeoutStore) TTL(ctx context.Context, token string) (time.Duration, error) {
+  var ttl time.Duration
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    ttl, err = t.Store.TTL(ctx, token)
+    return
+  })
+  if err != nil {
+    return 0, err
+  }
+  return ttl, nil
+}
+
+func (t *timeoutStore) Expire(ctx context.Context, token string, ttl time.Duration) error {
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return t.Store.Expire(ctx, token, ttl)
+  })
+}
+
+func (t *timeoutStore) ExpireAndSetLatestTime(ctx context.Context, token string, ttl time.Duration,
+  latestTime time.Time) error {
+
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return t.Store.ExpireAndSetLatestTime(ctx, token, ttl, latestTime)
+  })
+}
+
+func (t *timeoutStore) OverWrite(ctx context.Context, token string, value *Value, limit Limit) ([]Device, error) {
+  var evicted []Device
+  err := do(ctx, writeTimeout(), func(ctx context.Context) (err error) {
+    evicted, err = t.Store.OverWrite(ctx, token, value, limit)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return evicted, nil
+}
+
+func (t *timeoutStore) SetOrUseOld(ctx context.Context, token string, value *Value,
+  limit Limit) (string, []Device, error) {
+
+  var realToken string
+  var evicted []Device
+  err := do(ctx, writeTimeout(), func(ctx context.Context) (err error) {
+    realToken, evicted, err = t.Store.SetOrUseOld(ctx, token, value, limit)
+    return
+  })
+  if err != nil {
+    return "", nil, err
+  }
+  return realToken, evicted, nil
+}
+
+func (t *timeoutStore) Del(ctx context.Context, token string, value *Value) error {
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return t.Store.Del(ctx, token, value)
+  })
+}
+
+func (t *timeoutStore) DelClientId(ctx context.Context, uid string, clientId string) (string, error) {
+  var token string
+  err := do(ctx, writeTimeout(), func(ctx context.Context) (err error) {
+    token, err = t.Store.DelClientId(ctx, uid, clientId)
+    return
+  })
+  if err != nil {
+    return "", err
+  }
+  return token, nil
+}
+
+func (t *timeoutStore) DelAll(ctx context.Context, uid string) error {
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return t.Store.DelAll(ctx, uid)
+  })
+}
+
+func (t *timeoutStore) Find(ctx context.Context, uid string, clientId string) (string, error) {
+  var token string
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    token, err = t.Store.Find(ctx, uid, clientId)
+    return
+  })
+  if err != nil {
+    return "", err
+  }
+  return token, nil
+}
+
+func (t *timeoutStore) FindAll(ctx context.Context, uid string) ([]string, error) {
+  var tokens []string
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    tokens, err = t.Store.FindAll(ctx, uid)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return tokens, nil
+}
+
+func (t *timeoutStore) Evict(ctx context.Context, uid string, limit Limit) ([]Device, error) {
+  var evicted []Device
+  err := do(ctx, writeTimeout(), func(ctx context.Context) (err error) {
+    evicted, err = t.Store.Evict(ctx, uid, limit)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return evicted, nil
+}
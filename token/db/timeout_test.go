@@ -0,0 +1,97 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestDoWithTimeout(t *testing.T) {
+  useMemoryStore(t)
+
+  // f 在调用者的 goroutine 中执行，并得到带有超时的 ctx
+  err := doWithTimeout(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+    <-ctx.Done()
+    return ctx.Err()
+  })
+  if !errors.Is(err, ErrStoreUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("timeout: %v", err)
+  }
+
+  err = doWithTimeout(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+    return ErrNotFound
+  })
+  if !errors.Is(err, ErrNotFound) {
+    t.Errorf("not found: %v", err)
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  called := false
+  err = doWithTimeout(ctx, 0, func(ctx context.Context) error {
+    called = true
+    return nil
+  })
+  if called || err != context.Canceled {
+    t.Errorf("canceled: %v, called(%v)", err, called)
+  }
+
+  // 执行中调用者的 ctx 结束，不是存储不可用
+  ctx, cancel = context.WithCancel(context.Background())
+  err = doWithTimeout(ctx, 10*time.Millisecond, func(ctx context.Context) error {
+    cancel()
+    return StoreUnavailable(ctx.Err())
+  })
+  if err != context.Canceled {
+    t.Errorf("canceled during the call: %v", err)
+  }
+}
+
+func TestDoCanceledNotRecorded(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Degrade.FailureThreshold = 1
+  confValue.Degrade.OpenMs = 60 * 1000
+
+  for i := 0; i < 2; i++ {
+    ctx, cancel := context.WithCancel(context.Background())
+    err := do(ctx, 0, func(ctx context.Context) error {
+      cancel()
+      return StoreUnavailable(ctx.Err())
+    })
+    if err != context.Canceled {
+      t.Fatalf("canceled: %v", err)
+    }
+  }
+  if !storeBreaker.allow() {
+    t.Fatal("open by the canceled calls")
+  }
+
+  err := do(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+    <-ctx.Done()
+    return ctx.Err()
+  })
+  if !errors.Is(err, ErrStoreUnavailable) || storeBreaker.allow() {
+    t.Errorf("not open by the timeout: %v", err)
+  }
+}
+
+func TestClientTimeouts(t *testing.T) {
+  useMemoryStore(t)
+  def := time.Second
+  tests := []struct {
+    readMs, writeMs int64
+    read, write     time.Duration
+  }{
+    {0, 0, def, def},
+    {500, 1000, time.Second, time.Second},
+    {500, 200, 500 * time.Millisecond, 200 * time.Millisecond},
+    {300, 0, def, def},
+  }
+  for _, test := range tests {
+    confValue.Timeout.ReadMs, confValue.Timeout.WriteMs = test.readMs, test.writeMs
+    if read, write := clientTimeouts(def); read != test.read || write != test.write {
+      t.Errorf("%d, %d: %s, %s", test.readMs, test.writeMs, read, write)
+    }
+  }
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * 墓碑：token 被淘汰、被新的登录覆盖或者被删除(DelClientIdForUid、DelAllForUid)时，在存储中保留其原因一段时间
+ * (config 中的 tombstone.ttl)，之后再使用此 token 时返回 *RevokedError，客户端可以区分是过期还是被踢下线。
+ *
+ * 墓碑只是提示信息，在撤销之后写入，写入失败不影响撤销本身
+ */
+
+// 撤销的原因
+const (
+  // ReasonEvicted 设备数达到限制被淘汰，见 eviction.go
+  ReasonEvicted = "evicted"
+  // ReasonReplaced 同一个 ClientId 新的登录覆盖了此 token
+  ReasonReplaced = "replaced"
+  // ReasonExclusive 同一个互斥分组中新的登录，见 Value.Exclusive
+  ReasonExclusive = "exclusive"
+  // ReasonSignedOut 由 DelClientIdForUid 或者 DelAllForUid 删除，比如管理员踢下线
+  ReasonSignedOut = "signedOut"
+)
+
+type Tombstone struct {
+  Reason   string    `json:"reason"`
+  Uid      string    `json:"uid"`
+  // DelAllForUid 时为空
+  ClientId string    `json:"clientId"`
+  At       time.Time `json:"at"`
+  // 导致撤销的新登录的 ClientId，只有 ReasonEvicted、ReasonReplaced、ReasonExclusive 才有
+  By       string    `json:"by,omitempty"`
+}
+
+// Tombstoner 支持墓碑的 Store 实现此接口
+type Tombstoner interface {
+  // SetTombstones tombstones 为 token ---> 墓碑
+  SetTombstones(ctx context.Context, tombstones map[string]*Tombstone, ttl time.Duration) error
+  // Tombstone 没有墓碑时返回 ErrNotFound
+  Tombstone(ctx context.Context, token string) (*Tombstone, error)
+}
+
+var ErrTombstoneNotSupported = errors.New("token db: the store does not support tombstone")
+
+// RevokedError token 已经被撤销，同时可以 errors.Is 到原来的 ErrNotFound 或者 ErrExpired
+type RevokedError struct {
+  Tombstone *Tombstone
+  cause     error
+}
+
+func (e *RevokedError) Error() string {
+  return fmt.Sprintf("token db: revoked(%s), %v", e.Tombstone.Reason, e.cause)
+}
+
+func (e *RevokedError) Unwrap() error {
+  return e.cause
+}
+
+func (t *timeoutStore) SetTombstones(ctx context.Context, tombstones map[string]*Tombstone,
+  ttl time.Duration) error {
+
+  s, ok := t.Store.(Tombstoner)
+  if !ok {
+    return ErrTombstoneNotSupported
+  }
+  return do(ctx, writeTimeout(), func(ctx context.Context) error {
+    return s.SetTombstones(ctx, tombstones, ttl)
+  })
+}
+
+func (t *timeoutStore) Tombstone(ctx context.Context, token string) (*Tombstone, error) {
+  s, ok := t.Store.(Tombstoner)
+  if !ok {
+    return nil, ErrTombstoneNotSupported
+  }
+
+  var tombstone *Tombstone
+  err := do(ctx, readTimeout(), func(ctx context.Context) (err error) {
+    tombstone, err = s.Tombstone(ctx, token)
+    return
+  })
+  if err != nil {
+    return nil, err
+  }
+  return tombstone, nil
+}
+
+func tombstoneTTL() time.Duration {
+  return time.Duration(confValue.Tombstone.TTLMinutes) * time.Minute
+}
+
+// setTombstones 写入失败只记录日志
+func setTombstones(ctx context.Context, tombstones map[string]*Tombstone) {
+  if tombstoneTTL() <= 0 || len(tombstones) == 0 {
+    return
+  }
+
+  _, logger := log.WithCtx(ctx)
+  s, ok := currentStore().(Tombstoner)
+  if !ok {
+    return
+  }
+  err := s.SetTombstones(ctx, tombstones, tombstoneTTL())
+  if err != nil && !errors.Is(err, ErrTombstoneNotSupported) {
+    logger.Warning(fmt.Sprintf("set tombstones error, %s", err))
+  }
+}
+
+// evictedReason incoming 为正在写入的 token，没有时为 nil
+func evictedReason(incoming *Value, device Device) string {
+  if incoming != nil && incoming.Exclusive != "" && device.Exclusive == incoming.Exclusive {
+    return ReasonExclusive
+  }
+  return ReasonEvicted
+}
+
+// evictedTombstones incoming 写入时淘汰的 token 的墓碑
+func evictedTombstones(incoming *Value, evicted []Device, now time.Time) map[string]*Tombstone {
+  ret := make(map[string]*Tombstone, len(evicted))
+  for _, device := range evicted {
+    ret[device.Token] = &Tombstone{Reason: evictedReason(incoming, device), Uid: incoming.Uid,
+      ClientId: device.ClientId, At: now, By: incoming.ClientId}
+  }
+  return ret
+}
+
+// withTombstone err 为 ErrNotFound 或者 ErrExpired 时，如果 token 有墓碑，返回 *RevokedError
+func (db *DB) withTombstone(err error) error {
+  if tombstoneTTL() <= 0 || !(errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired)) {
+    return err
+  }
+
+  tombstone, tErr := TombstoneWithErr(db.ctx, db.key)
+  if tErr != nil {
+    return err
+  }
+  return &RevokedError{Tombstone: tombstone, cause: err}
+}
+
+// TombstoneWithErr token 为存储中使用的值，没有墓碑时返回 ErrNotFound
+func TombstoneWithErr(ctx context.Context, token string) (*Tombstone, error) {
+  s, ok := currentStore().(Tombstoner)
+  if !ok {
+    return nil, ErrTombstoneNotSupported
+  }
+  return s.Tombstone(ctx, token)
+}
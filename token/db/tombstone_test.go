@@ -0,0 +1,70 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestTombstoneReasons(t *testing.T) {
+  ctx := context.Background()
+
+  tests := []struct {
+    name string
+    // revoke 撤销 t1(u1 的 c1)
+    revoke func(t *testing.T)
+    reason string
+    by     string
+  }{
+    {"evicted", func(t *testing.T) {
+      confValue.AllowDevices.Min = 1
+      confValue.AllowDevices.Max = 2
+      newToken(t, "t2", Value{Uid: "u1", ClientId: "c2", LatestTime: time.Now()})
+    }, ReasonEvicted, "c2"},
+    {"replaced", func(t *testing.T) {
+      newToken(t, "t2", Value{Uid: "u1", ClientId: "c1"})
+    }, ReasonReplaced, "c1"},
+    {"exclusive", func(t *testing.T) {
+      newToken(t, "t2", Value{Uid: "u1", ClientId: "c2", Exclusive: "mobile"})
+    }, ReasonExclusive, "c2"},
+    {"delClientId", func(t *testing.T) {
+      DelClientIdForUid(ctx, "u1", "c1")
+    }, ReasonSignedOut, ""},
+    {"delAll", func(t *testing.T) {
+      DelAllForUid(ctx, "u1")
+    }, ReasonSignedOut, ""},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      useMemoryStore(t)
+      confValue.Tombstone.TTLMinutes = 10
+      newToken(t, "t1", Value{Uid: "u1", ClientId: "c1", Exclusive: "mobile"})
+
+      test.revoke(t)
+      _, err := New(ctx, "t1").UidWithErr()
+      revoked := &RevokedError{}
+      if !errors.As(err, &revoked) || !errors.Is(err, ErrNotFound) {
+        t.Fatalf("%v", err)
+      }
+      if ts := revoked.Tombstone; ts.Reason != test.reason || ts.Uid != "u1" || ts.By != test.by {
+        t.Errorf("%+v", ts)
+      }
+    })
+  }
+}
+
+func TestTombstoneDisabled(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Tombstone.TTLMinutes = 0
+  ctx := context.Background()
+
+  newToken(t, "t1", Value{Uid: "u1", ClientId: "c1"})
+  newToken(t, "t2", Value{Uid: "u1", ClientId: "c1"})
+  _, err := New(ctx, "t1").UidWithErr()
+  revoked := &RevokedError{}
+  if errors.As(err, &revoked) || !errors.Is(err, ErrNotFound) {
+    t.Errorf("%v", err)
+  }
+}
@@ -6,35 +6,89 @@ import (
 )
 
 type Value struct {
-	Uid        string
-	ClientId   string
+	Uid         string
+	ClientId    string
+	// 客户端的类型，比如 web、phone、tv，不同的类型可以配置不同的 MaxTTL 及设备数，见 policy.go
+	ClientType  string
+	// 互斥的登录分组，同一个 uid 在一个分组中只有一个 token，新的登录会撤销分组中其他 ClientId 的 token，见 eviction.go
+	Exclusive   string
 	// 具体意义由使用方决定传入什么，比如最后通信、最后登录等
-	LatestTime time.Time
-	Session    string
-}
-
-func (v *Value) uidKey() string {
-	return uidKey(v.Uid)
+	LatestTime  time.Time
+	Session     string
+	// 只有 access token 才有，为其 refresh token 在存储中使用的值，见 access.go
+	Refresh     string
+	// refresh token 只用于换取 access token
+	RefreshOnly bool
+	// 同一次登录的 refresh token 及 access token 属于同一个 family，见 family.go
+	Family      string
+	// 登录的时间，写入时由 DB 设置，精确到毫秒，用于限制登录的最长时间(见 lifetime.go)及 NotBefore(见 notbefore.go)
+	IssuedAt    time.Time
 }
 
 const (
 	vUid = "uid"
 	vClientId = "clientId"
+	vClientType = "clientType"
+	vExclusive = "exclusive"
 	vSession = "session"
 	vLatestTime = "latestTime"
+	vRefresh = "refresh"
+	vRefreshOnly = "refreshOnly"
+	vFamily = "family"
+	vIssuedAt = "issuedAt"
+	// 已经轮换过的 refresh token，只在存储中使用
+	vRotated = "rotated"
 )
 
 func encodeLastTime(lastTime time.Time) string {
 	return strconv.FormatInt(lastTime.Unix(), 10)
 }
 
+// msThreshold 之前以 unix 秒写入的时间都小于此值，unix 毫秒都大于此值(1973 年之后)
+const msThreshold = 100000000000
+
+// unixMs 零值的时间转换为 0，脚本中 0 表示不限制
+func unixMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMs 小于 msThreshold 的是之前以 unix 秒写入的
+func fromMs(ms int64) time.Time {
+	if ms < msThreshold {
+		return time.Unix(ms, 0)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func encodeMs(t time.Time) string {
+	return strconv.FormatInt(unixMs(t), 10)
+}
+
+func decodeMs(str string) time.Time {
+	ms, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		ms = 0
+	}
+
+	return fromMs(ms)
+}
+
 func (v *Value) toMap() map[string]interface{} {
 	m := make(map[string]interface{})
 	// 都使用string 方便反序列化
 	m[vUid] = v.Uid
 	m[vClientId] = v.ClientId
+	m[vClientType] = v.ClientType
+	m[vExclusive] = v.Exclusive
 	m[vSession] = v.Session
 	m[vLatestTime] = encodeLastTime(v.LatestTime)
+	m[vRefresh] = v.Refresh
+	m[vRefreshOnly] = strconv.FormatBool(v.RefreshOnly)
+	m[vFamily] = v.Family
+	m[vIssuedAt] = encodeMs(v.IssuedAt)
 
 	return m
 }
@@ -51,9 +105,18 @@ func decodeLastTime(str string) time.Time {
 func fromMap(m map[string]string) *Value {
 	v := &Value{}
 	v.ClientId = m[vClientId]
+	v.ClientType = m[vClientType]
+	v.Exclusive = m[vExclusive]
 	v.Uid = m[vUid]
 	v.Session = m[vSession]
 	v.LatestTime = decodeLastTime(m[vLatestTime])
+	v.Refresh = m[vRefresh]
+	v.RefreshOnly, _ = strconv.ParseBool(m[vRefreshOnly])
+	v.Family = m[vFamily]
+	// 没有 issuedAt 的是之前写入的 token
+	if issuedAt := decodeMs(m[vIssuedAt]); issuedAt.Unix() > 0 {
+		v.IssuedAt = issuedAt
+	}
 
 	return v
 }
@@ -0,0 +1,80 @@
+package token
+
+import (
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "strings"
+)
+
+/**
+ * 配置了 Format.Prefix 后，token 使用结构化的格式：
+ *
+ *   <prefix>_v1_<random>_<crc32>
+ *
+ *   random: IDGenerator 生成的值
+ *   crc32:  8 位 hex，为 "<prefix>_v1_<random>" 的 CRC32(IEEE)
+ *
+ * redis cluster 模式下，前面还有 "<slot tag>."。
+ * 格式或者校验和不对的 token 在访问存储之前就被拒绝；泄露的 token 可以被扫描工具用
+ * `<prefix>_v1_[A-Za-z0-9_-]+_[0-9a-f]{8}` 匹配，再用 ValidFormat 确认
+ */
+
+const formatVersion = "v1"
+
+// ErrMalformed token 的格式或者校验和不对
+var ErrMalformed = errors.New("token: malformed")
+
+func formatEnabled() bool {
+  return confValue.Format.Prefix != ""
+}
+
+func checksum(s string) string {
+  return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(s)))
+}
+
+func format(random string) string {
+  if !formatEnabled() {
+    return random
+  }
+
+  s := confValue.Format.Prefix + "_" + formatVersion + "_" + random
+  return s + "_" + checksum(s)
+}
+
+// stripSlot 去掉 slot tag
+func stripSlot(token string) string {
+  if i := strings.LastIndex(token, "."); i >= 0 {
+    return token[i+1:]
+  }
+  return token
+}
+
+// ValidFormat token 是否为当前配置的格式并且校验和正确
+func ValidFormat(token string) bool {
+  token = stripSlot(token)
+
+  head := confValue.Format.Prefix + "_" + formatVersion + "_"
+  if !strings.HasPrefix(token, head) {
+    return false
+  }
+
+  i := strings.LastIndex(token, "_")
+  if i < len(head) {
+    return false
+  }
+
+  return token[i+1:] == checksum(token[:i])
+}
+
+// checkFormat 没有配置格式时不检查；配置了 Format.AcceptUnformatted 时，只接受没有 prefix 的旧 token，
+// 有 prefix 的 token 仍然需要格式及校验和正确
+func checkFormat(token string) error {
+  if !formatEnabled() || ValidFormat(token) {
+    return nil
+  }
+  if confValue.Format.AcceptUnformatted && !strings.HasPrefix(stripSlot(token), confValue.Format.Prefix+"_") {
+    return nil
+  }
+  return ErrMalformed
+}
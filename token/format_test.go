@@ -0,0 +1,40 @@
+package token
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestCheckFormat(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Format.Prefix = "app"
+
+  valid := format("abc")
+  tests := []struct {
+    token             string
+    acceptUnformatted bool
+    err               error
+  }{
+    {valid, false, nil},
+    {"{u1}." + valid, false, nil},
+    {valid[:len(valid)-1] + "0", false, ErrMalformed},
+    {"abc", false, ErrMalformed},
+    {"abc", true, nil},
+    {"{u1}.abc", true, nil},
+    // 有 prefix 的 token 总是检查校验和
+    {valid[:len(valid)-1] + "0", true, ErrMalformed},
+    {"app_v1_abc", true, ErrMalformed},
+    {"app_x", true, ErrMalformed},
+  }
+  for _, test := range tests {
+    confValue.Format.AcceptUnformatted = test.acceptUnformatted
+    if err := checkFormat(test.token); !errors.Is(err, test.err) {
+      t.Errorf("%s(acceptUnformatted: %v): %v", test.token, test.acceptUnformatted, err)
+    }
+  }
+
+  confValue.Format.Prefix = ""
+  if err := checkFormat("abc"); err != nil {
+    t.Errorf("no format: %v", err)
+  }
+}
@@ -0,0 +1,93 @@
+package token
+
+import (
+  "crypto/rand"
+  "encoding/base32"
+  "encoding/base64"
+  "encoding/hex"
+  "fmt"
+  "github.com/xpwu/go-api-token/token/db"
+  "sync"
+)
+
+// IDGenerator 生成 token 的值，可通过 SetIDGenerator 替换为自定义的格式，或者测试中使用确定的值
+type IDGenerator interface {
+  NewId(uid, clientId string) string
+}
+
+type IDGeneratorFunc func(uid, clientId string) string
+
+func (f IDGeneratorFunc) NewId(uid, clientId string) string {
+  return f(uid, clientId)
+}
+
+const (
+  HexEncoding       = "hex"
+  Base64URLEncoding = "base64url"
+  Base32Encoding    = "base32"
+)
+
+// RandomIDGenerator 使用 crypto/rand 生成 Bytes 个随机字节，并按 Encoding 编码，与 uid、clientId 无关
+type RandomIDGenerator struct {
+  Bytes    int
+  Encoding string
+}
+
+func NewRandomIDGenerator(bytes int, encoding string) *RandomIDGenerator {
+  if bytes < 16 {
+    panic(fmt.Sprintf("token id: bytes(%d) must be at least 16", bytes))
+  }
+
+  switch encoding {
+  case HexEncoding, Base64URLEncoding, Base32Encoding:
+  default:
+    panic(fmt.Sprintf("token id: unknown encoding(%s), must be one of %s, %s, %s",
+      encoding, HexEncoding, Base64URLEncoding, Base32Encoding))
+  }
+
+  return &RandomIDGenerator{Bytes: bytes, Encoding: encoding}
+}
+
+func (g *RandomIDGenerator) NewId(uid, clientId string) string {
+  b := make([]byte, g.Bytes)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+
+  switch g.Encoding {
+  case Base64URLEncoding:
+    return base64.RawURLEncoding.EncodeToString(b)
+  case Base32Encoding:
+    return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+  default:
+    return hex.EncodeToString(b)
+  }
+}
+
+var (
+  generator   IDGenerator
+  generatorMu sync.Mutex
+)
+
+// SetIDGenerator 替换配置中的随机生成器，应在使用 token 之前调用
+func SetIDGenerator(g IDGenerator) {
+  generatorMu.Lock()
+  defer generatorMu.Unlock()
+  generator = g
+}
+
+func currentIDGenerator() IDGenerator {
+  generatorMu.Lock()
+  defer generatorMu.Unlock()
+
+  // 配置在 init 之后才读取
+  if generator == nil {
+    generator = NewRandomIDGenerator(confValue.Id.Bytes, confValue.Id.Encoding)
+  }
+  return generator
+}
+
+// NewId 生成 uid 在 clientId 上的新 token
+func NewId(uid, clientId string) string {
+  return db.SlotToken(uid, format(currentIDGenerator().NewId(uid, clientId)))
+}
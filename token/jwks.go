@@ -0,0 +1,262 @@
+package token
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rsa"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/**
+ * JWKS：发布 RS256/ES256 的公钥，供其他服务离线验证 JWT。HS256 的 key 不发布。
+ *
+ * 发布方见 KeyRing.JWKS 及 tapi.JWKSSuite，验证方见 JWKSVerifier
+ */
+
+type JWK struct {
+  Kty string `json:"kty"`
+  Kid string `json:"kid"`
+  Alg string `json:"alg"`
+  Use string `json:"use"`
+
+  // RSA
+  N string `json:"n,omitempty"`
+  E string `json:"e,omitempty"`
+
+  // EC
+  Crv string `json:"crv,omitempty"`
+  X   string `json:"x,omitempty"`
+  Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+  Keys []JWK `json:"keys"`
+}
+
+func newJWK(key *Key) (JWK, bool) {
+  jwk := JWK{Kid: key.Kid, Alg: key.Alg, Use: "sig"}
+
+  switch pub := key.public.(type) {
+  case *rsa.PublicKey:
+    jwk.Kty = "RSA"
+    jwk.N = b64.EncodeToString(pub.N.Bytes())
+    jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+  case *ecdsa.PublicKey:
+    jwk.Kty = "EC"
+    jwk.Crv = "P-256"
+    x, y := make([]byte, 32), make([]byte, 32)
+    pub.X.FillBytes(x)
+    pub.Y.FillBytes(y)
+    jwk.X = b64.EncodeToString(x)
+    jwk.Y = b64.EncodeToString(y)
+  default:
+    return jwk, false
+  }
+
+  return jwk, true
+}
+
+// Key 转换为只能用于验证的 Key
+func (j *JWK) Key() (*Key, error) {
+  decode := func(name string, s string) (*big.Int, error) {
+    b, err := b64.DecodeString(s)
+    if err != nil || len(b) == 0 {
+      return nil, fmt.Errorf("token jwks: invalid '%s' of key(%s)", name, j.Kid)
+    }
+    return new(big.Int).SetBytes(b), nil
+  }
+
+  key := &Key{Kid: j.Kid}
+
+  switch {
+  case j.Kty == "RSA" && (j.Alg == RS256 || j.Alg == ""):
+    n, err := decode("n", j.N)
+    if err != nil {
+      return nil, err
+    }
+    e, err := decode("e", j.E)
+    if err != nil {
+      return nil, err
+    }
+    if !e.IsInt64() || e.Int64() > 1<<31-1 {
+      return nil, fmt.Errorf("token jwks: invalid 'e' of key(%s)", j.Kid)
+    }
+    key.Alg = RS256
+    key.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+  case j.Kty == "EC" && j.Crv == "P-256" && (j.Alg == ES256 || j.Alg == ""):
+    x, err := decode("x", j.X)
+    if err != nil {
+      return nil, err
+    }
+    y, err := decode("y", j.Y)
+    if err != nil {
+      return nil, err
+    }
+    if !elliptic.P256().IsOnCurve(x, y) {
+      return nil, fmt.Errorf("token jwks: the point of key(%s) is not on P-256", j.Kid)
+    }
+    key.Alg = ES256
+    key.public = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+  default:
+    return nil, fmt.Errorf("token jwks: unsupported key(%s), kty=%s, alg=%s", j.Kid, j.Kty, j.Alg)
+  }
+
+  return key, nil
+}
+
+// JWKS 可用于验证的公钥，包括还没有生效的，使验证方在轮换之前就能拿到新的公钥
+func (r *KeyRing) JWKS(now time.Time) *JWKS {
+  ret := &JWKS{Keys: make([]JWK, 0)}
+  for _, key := range r.Active(now) {
+    if jwk, ok := newJWK(key); ok {
+      ret.Keys = append(ret.Keys, jwk)
+    }
+  }
+  return ret
+}
+
+/**
+ * JWKSVerifier 从 url 获取 JWKS 并缓存，用于在其他服务中验证 JWT，不访问 token 的存储，也不检查是否已注销。
+ *
+ * 缓存的时间优先使用响应中 Cache-Control 的 max-age，没有时使用 maxAge。
+ * 遇到未知的 kid 时(通常是 key 刚刚轮换)会重新获取，但两次获取的间隔不少于 minRefresh，所以伪造的 kid 不会
+ * 使每个请求都去获取。获取失败时继续使用已经缓存的 key。
+ *
+ * 获取时不持有锁，同一时间只有一个获取：其间缓存中已有的 kid 直接使用缓存(即使已过期)，未知的 kid 等待这次获取的结果
+ */
+type JWKSVerifier struct {
+  url    string
+  client *http.Client
+  maxAge time.Duration
+  // 两次获取的最小间隔
+  minRefresh time.Duration
+
+  mu        sync.Mutex
+  keys      map[string]*Key
+  fetchedAt time.Time
+  expiresAt time.Time
+  // 正在获取时不为 nil，获取结束时关闭
+  fetching chan struct{}
+}
+
+func NewJWKSVerifier(url string, maxAge time.Duration) *JWKSVerifier {
+  return &JWKSVerifier{
+    url:        url,
+    client:     &http.Client{Timeout: 10 * time.Second},
+    maxAge:     maxAge,
+    minRefresh: time.Minute,
+    keys:       map[string]*Key{},
+  }
+}
+
+// Verify 与 VerifyJWT 相同，只验证签名与有效期，issuer 按本服务的配置检查
+func (v *JWKSVerifier) Verify(token string) (*Claims, error) {
+  if !isJWT(token) {
+    return nil, ErrMalformed
+  }
+  return decodeJWT(v.lookup, token, time.Now())
+}
+
+func (v *JWKSVerifier) lookup(kid string, now time.Time) (*Key, bool) {
+  v.mu.Lock()
+  key, ok := v.keys[kid]
+
+  if fetching := v.fetching; fetching != nil {
+    v.mu.Unlock()
+    if ok {
+      return key, true
+    }
+    <-fetching
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    key, ok = v.keys[kid]
+    return key, ok
+  }
+
+  if (ok && now.Before(v.expiresAt)) || now.Before(v.fetchedAt.Add(v.minRefresh)) {
+    v.mu.Unlock()
+    return key, ok
+  }
+
+  // 失败时继续使用旧的缓存，minRefresh 之后再重试
+  fetching := make(chan struct{})
+  v.fetching = fetching
+  v.fetchedAt = now
+  v.mu.Unlock()
+
+  keys, expiresAt, err := v.fetch(now)
+
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  close(fetching)
+  v.fetching = nil
+  if err != nil {
+    log.Error(err)
+  } else {
+    v.keys = keys
+    v.expiresAt = expiresAt
+  }
+
+  key, ok = v.keys[kid]
+  return key, ok
+}
+
+// fetch 获取 JWKS，不修改缓存，不需要持有锁
+func (v *JWKSVerifier) fetch(now time.Time) (keys map[string]*Key, expiresAt time.Time, err error) {
+  res, err := v.client.Get(v.url)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return nil, time.Time{}, fmt.Errorf("token jwks: get %s, status %d", v.url, res.StatusCode)
+  }
+
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    return nil, time.Time{}, err
+  }
+  jwks := &JWKS{}
+  if err = json.Unmarshal(body, jwks); err != nil {
+    return nil, time.Time{}, err
+  }
+
+  keys = make(map[string]*Key, len(jwks.Keys))
+  for i := range jwks.Keys {
+    // 不支持的 key 忽略，不影响其他 key 的使用
+    if key, err := jwks.Keys[i].Key(); err == nil {
+      keys[key.Kid] = key
+    }
+  }
+  if len(keys) == 0 {
+    return nil, time.Time{}, errors.New("token jwks: no supported key in " + v.url)
+  }
+
+  return keys, now.Add(maxAge(res.Header.Get("Cache-Control"), v.maxAge)), nil
+}
+
+func maxAge(cacheControl string, def time.Duration) time.Duration {
+  for _, directive := range strings.Split(cacheControl, ",") {
+    directive = strings.TrimSpace(directive)
+    if !strings.HasPrefix(directive, "max-age=") {
+      continue
+    }
+    if seconds, err := strconv.ParseInt(directive[len("max-age="):], 10, 64); err == nil {
+      return time.Duration(seconds) * time.Second
+    }
+  }
+  return def
+}
@@ -0,0 +1,91 @@
+package token
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "encoding/json"
+  "encoding/pem"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func newECKey(t *testing.T, kid string) *Key {
+  private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  der, err := x509.MarshalECPrivateKey(private)
+  if err != nil {
+    t.Fatal(err)
+  }
+  key, err := ParsePEMKey(kid, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return key
+}
+
+func TestJWKSVerifierLookup(t *testing.T) {
+  jwk, _ := newJWK(newECKey(t, "k1"))
+  var fetches int32
+  // 关闭之前，获取一直阻塞
+  release := make(chan struct{})
+  entered := make(chan struct{}, 10)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&fetches, 1)
+    entered <- struct{}{}
+    <-release
+    _ = json.NewEncoder(w).Encode(&JWKS{Keys: []JWK{jwk}})
+  }))
+  defer server.Close()
+
+  v := NewJWKSVerifier(server.URL, time.Hour)
+  now := time.Now()
+
+  // 同时查找未知的 kid，只获取一次
+  wg := sync.WaitGroup{}
+  for i := 0; i < 5; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if _, ok := v.lookup("k1", now); !ok {
+        t.Error("k1 is not found")
+      }
+    }()
+  }
+  <-entered
+  close(release)
+  wg.Wait()
+  if n := atomic.LoadInt32(&fetches); n != 1 {
+    t.Fatalf("fetches: %d", n)
+  }
+
+  // minRefresh 内，伪造的 kid 不会再获取
+  if _, ok := v.lookup("forged", now.Add(time.Second)); ok {
+    t.Fatal("forged kid is found")
+  }
+  if n := atomic.LoadInt32(&fetches); n != 1 {
+    t.Fatalf("fetches after the forged kid: %d", n)
+  }
+
+  // 获取期间，已缓存的 kid 不等待
+  release = make(chan struct{})
+  later := now.Add(2 * time.Hour)
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    v.lookup("k2", later)
+  }()
+  <-entered
+  if _, ok := v.lookup("k1", later); !ok {
+    t.Error("the cached k1 is not found while fetching")
+  }
+  close(release)
+  <-done
+}
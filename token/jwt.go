@@ -0,0 +1,340 @@
+package token
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-api-token/token/db"
+  "github.com/xpwu/go-log/log"
+  "io/ioutil"
+  "strings"
+  "sync"
+  "time"
+)
+
+/**
+ * JWT：与无状态 token 一样，验证时不需要访问存储，供其他服务及网关直接验证。
+ *
+ * db.Value 与 claims 的对应关系：
+ *   Uid ---> sub
+ *   ClientId ---> cid
+ *   Session ---> ses
+ *   LatestTime ---> lat
+ * 另有 jti、iss、iat、exp，及与 NotBefore 比较的 iatms(iat 的 unix 毫秒，见 stateless.go)。
+ *
+ * 支持 HS256、RS256、ES256，注销与无状态 token 相同，见 stateless.go。
+ * 签名的 key 由 JWTKeyRing 管理，header 中的 kid 指明所用的 key，key 的轮换见 keyring.go
+ */
+
+const (
+  HS256 = "HS256"
+  RS256 = "RS256"
+  ES256 = "ES256"
+)
+
+type jwtHeader struct {
+  Alg string `json:"alg"`
+  Typ string `json:"typ"`
+  Kid string `json:"kid,omitempty"`
+}
+
+type jwtPayload struct {
+  Subject    string `json:"sub"`
+  ClientId   string `json:"cid"`
+  Session    string `json:"ses,omitempty"`
+  LatestTime int64  `json:"lat,omitempty"`
+  Id         string `json:"jti"`
+  Issuer     string `json:"iss,omitempty"`
+  IssuedAt   int64  `json:"iat"`
+  IssuedAtMs int64  `json:"iatms,omitempty"`
+  ExpiresAt  int64  `json:"exp"`
+}
+
+func (p *jwtPayload) claims() *Claims {
+  return &Claims{
+    Id:         p.Id,
+    Uid:        p.Subject,
+    ClientId:   p.ClientId,
+    Session:    p.Session,
+    LatestTime: p.LatestTime,
+    IssuedAt:   p.IssuedAt,
+    IssuedAtMs: p.IssuedAtMs,
+    ExpiresAt:  p.ExpiresAt,
+  }
+}
+
+var b64 = base64.RawURLEncoding
+
+// legacyJWTKey 配置中 alg/secret/privateKeyFile/publicKeyFile 指定的 key，kid 为 ""，没有配置时返回 nil
+func legacyJWTKey() (*Key, error) {
+  conf := &confValue.JWT
+
+  switch {
+  case conf.Alg == HS256 && conf.Secret != "":
+    return NewHMACKey("", []byte(conf.Secret)), nil
+  case conf.Alg == HS256:
+    return nil, nil
+  case conf.PrivateKeyFile != "":
+    return loadLegacyPEMKey(conf.PrivateKeyFile)
+  case conf.PublicKeyFile != "":
+    return loadLegacyPEMKey(conf.PublicKeyFile)
+  }
+
+  return nil, fmt.Errorf("token jwt: privateKeyFile or publicKeyFile is not set for %s", conf.Alg)
+}
+
+func loadLegacyPEMKey(file string) (*Key, error) {
+  data, err := ioutil.ReadFile(file)
+  if err != nil {
+    return nil, err
+  }
+  key, err := ParsePEMKey("", data)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %w", file, err)
+  }
+  if key.Alg != confValue.JWT.Alg {
+    return nil, fmt.Errorf("token jwt: the key(%s) does not match alg(%s)", file, confValue.JWT.Alg)
+  }
+  return key, nil
+}
+
+func loadJWTKeyRing() (*KeyRing, error) {
+  conf := &confValue.JWT
+  ring := NewKeyRing(time.Duration(conf.TTLMinutes) * time.Minute)
+
+  legacy, err := legacyJWTKey()
+  if err != nil {
+    return nil, err
+  }
+  if legacy != nil {
+    if err = ring.Add(legacy); err != nil {
+      return nil, err
+    }
+  }
+
+  for _, c := range conf.Keys {
+    var key *Key
+    if c.Secret != "" {
+      key = NewHMACKey(c.Kid, []byte(c.Secret))
+    } else if key, err = loadPEMFile(c.Kid, c.File); err != nil {
+      return nil, err
+    }
+
+    // 没有指定时立即生效，此前的 key 从此时开始退役
+    key.NotBefore = time.Now()
+    if c.NotBefore != "" {
+      if key.NotBefore, err = time.Parse(time.RFC3339, c.NotBefore); err != nil {
+        return nil, fmt.Errorf("token jwt: notBefore of key(%s), %w", c.Kid, err)
+      }
+    }
+
+    if err = ring.Add(key); err != nil {
+      return nil, err
+    }
+  }
+
+  if conf.KeyDir != "" {
+    if err = ring.LoadDir(conf.KeyDir); err != nil {
+      return nil, err
+    }
+  }
+
+  if len(ring.Active(time.Now())) == 0 {
+    return nil, ErrJWTNotConfigured
+  }
+
+  return ring, nil
+}
+
+var (
+  jwtRingMu sync.Mutex
+  jwtRing   *KeyRing
+  // 最近一次创建失败，jwtRetryInterval 之内不再重新读取 key 文件
+  jwtRingErr      error
+  jwtRingFailedAt time.Time
+)
+
+const jwtRetryInterval = 10 * time.Second
+
+// ErrJWTNotConfigured 配置中没有任何 JWT 的 key
+var ErrJWTNotConfigured = errors.New("token jwt: no key is set")
+
+// jwtConfigured 不读取文件，只检查配置中是否有 key
+func jwtConfigured() bool {
+  conf := &confValue.JWT
+  return conf.Secret != "" || conf.PrivateKeyFile != "" || conf.PublicKeyFile != "" ||
+    len(conf.Keys) != 0 || conf.KeyDir != ""
+}
+
+// JWTKeyRing 签名及验证 JWT 的 KeyRing，由配置创建，可以在运行时 Add/Rotate。
+// 没有配置时返回 ErrJWTNotConfigured；创建失败时，jwtRetryInterval 之后的调用会重新创建
+func JWTKeyRing() (*KeyRing, error) {
+  jwtRingMu.Lock()
+  defer jwtRingMu.Unlock()
+
+  // 配置在 init 之后才读取
+  if jwtRing != nil {
+    return jwtRing, nil
+  }
+  if !jwtConfigured() {
+    return nil, ErrJWTNotConfigured
+  }
+
+  if jwtRingErr != nil && time.Since(jwtRingFailedAt) < jwtRetryInterval {
+    return nil, jwtRingErr
+  }
+
+  ring, err := loadJWTKeyRing()
+  if err != nil {
+    jwtRingErr, jwtRingFailedAt = err, time.Now()
+    return nil, err
+  }
+  jwtRing, jwtRingErr = ring, nil
+  return jwtRing, nil
+}
+
+// verifyingJWTKey 没有配置 JWT 时，任何 JWT 都视为格式不对
+func verifyingJWTKey(kid string, now time.Time) (*Key, bool) {
+  ring, err := JWTKeyRing()
+  if err != nil {
+    return nil, false
+  }
+  return ring.Verifying(kid, now)
+}
+
+func isJWT(token string) bool {
+  return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+func encodeJWT(key *Key, payload *jwtPayload) (string, error) {
+  header, err := json.Marshal(&jwtHeader{Alg: key.Alg, Typ: "JWT", Kid: key.Kid})
+  if err != nil {
+    return "", err
+  }
+  body, err := json.Marshal(payload)
+  if err != nil {
+    return "", err
+  }
+
+  data := b64.EncodeToString(header) + "." + b64.EncodeToString(body)
+  sig, err := key.sign([]byte(data))
+  if err != nil {
+    return "", err
+  }
+
+  return data + "." + b64.EncodeToString(sig), nil
+}
+
+// keyLookup 按 kid 查找可用于验证的 key
+type keyLookup func(kid string, now time.Time) (*Key, bool)
+
+// decodeJWT 格式、签名不对返回 ErrMalformed，过期返回 ErrExpired
+func decodeJWT(lookup keyLookup, token string, now time.Time) (*Claims, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return nil, ErrMalformed
+  }
+
+  headerData, err := b64.DecodeString(parts[0])
+  if err != nil {
+    return nil, ErrMalformed
+  }
+  header := &jwtHeader{}
+  if err = json.Unmarshal(headerData, header); err != nil {
+    return nil, ErrMalformed
+  }
+  // 没有 kid 或者 key 已经退役，都视为签名不对
+  key, ok := lookup(header.Kid, now)
+  // 必须与 key 的 alg 一致，防止 alg 替换攻击
+  if !ok || header.Alg != key.Alg {
+    return nil, ErrMalformed
+  }
+
+  sig, err := b64.DecodeString(parts[2])
+  if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+    return nil, ErrMalformed
+  }
+
+  body, err := b64.DecodeString(parts[1])
+  if err != nil {
+    return nil, ErrMalformed
+  }
+  payload := &jwtPayload{}
+  if err = json.Unmarshal(body, payload); err != nil {
+    return nil, ErrMalformed
+  }
+
+  if confValue.JWT.Issuer != "" && payload.Issuer != confValue.JWT.Issuer {
+    return nil, ErrMalformed
+  }
+
+  claims := payload.claims()
+  if !now.Before(claims.expiresAt()) {
+    return nil, ErrExpired
+  }
+
+  return claims, nil
+}
+
+// VerifyJWT 只验证签名与有效期，不检查是否已注销，供不能访问存储的服务使用
+func VerifyJWT(token string) (*Claims, error) {
+  return decodeJWT(verifyingJWTKey, token, time.Now())
+}
+
+func NewJWTWithErr(ctx context.Context, value db.Value) (*Token, error) {
+  _, logger := log.WithCtx(ctx)
+
+  checkValue(&value)
+
+  now := db.IssuedAtNow()
+  payload := &jwtPayload{
+    Subject:    value.Uid,
+    ClientId:   value.ClientId,
+    Session:    value.Session,
+    Id:         currentIDGenerator().NewId(value.Uid, value.ClientId),
+    Issuer:     confValue.JWT.Issuer,
+    IssuedAt:   now.Unix(),
+    IssuedAtMs: now.UnixNano() / int64(time.Millisecond),
+    ExpiresAt:  now.Add(time.Duration(confValue.JWT.TTLMinutes) * time.Minute).Unix(),
+  }
+  if !value.LatestTime.IsZero() {
+    payload.LatestTime = value.LatestTime.Unix()
+  }
+
+  ring, err := JWTKeyRing()
+  if err != nil {
+    logger.Error(err)
+    return nil, err
+  }
+  key, err := ring.Signing(now)
+  if err != nil {
+    logger.Error(err)
+    return nil, err
+  }
+
+  jwt, err := encodeJWT(key, payload)
+  if err != nil {
+    logger.Error(err)
+    return nil, err
+  }
+
+  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>jwt(%s)", value.Uid, value.ClientId, payload.Id))
+
+  ret := &Token{DB: db.New(ctx, jwt), ctx: ctx, claims: payload.claims()}
+  notify(ctx, &Event{Kind: EventNew, Uid: value.Uid, ClientId: value.ClientId, Token: jwt})
+  ret.uid = func() string {
+    return value.Uid
+  }
+  return ret, nil
+}
+
+// NewJWT 生成 JWT，不访问存储。没有配置 JWT 的 key 时 panic，处理请求时应使用 NewJWTWithErr
+func NewJWT(ctx context.Context, value db.Value) *Token {
+  ret, err := NewJWTWithErr(ctx, value)
+  if err != nil {
+    panic(err)
+  }
+  return ret
+}
@@ -0,0 +1,143 @@
+package token
+
+import (
+  "context"
+  "encoding/base64"
+  "errors"
+  "strings"
+  "testing"
+  "time"
+  "github.com/xpwu/go-api-token/token/db"
+)
+
+// resetJWTKeyRing 配置改变后重新创建 KeyRing
+func resetJWTKeyRing(t *testing.T) {
+  reset := func() {
+    jwtRingMu.Lock()
+    defer jwtRingMu.Unlock()
+    jwtRing, jwtRingErr = nil, nil
+  }
+  reset()
+  t.Cleanup(reset)
+}
+
+func TestJWTNotConfigured(t *testing.T) {
+  useMemoryStore(t)
+  resetJWTKeyRing(t)
+
+  ctx := context.Background()
+  if _, err := NewJWTWithErr(ctx, db.Value{Uid: "u1", ClientId: "c1"}); !errors.Is(err, ErrJWTNotConfigured) {
+    t.Fatalf("NewJWTWithErr: %v", err)
+  }
+
+  // 多次验证都不会 panic
+  for i := 0; i < 2; i++ {
+    if _, err := Resume(ctx, "eyJhbGciOiJIUzI1NiJ9.eyJ9.x").UidOrInvalidWithErr(); !errors.Is(err, ErrMalformed) {
+      t.Fatalf("%d: %v", i, err)
+    }
+    if _, err := VerifyJWT("eyJhbGciOiJIUzI1NiJ9.eyJ9.x"); !errors.Is(err, ErrMalformed) {
+      t.Fatalf("%d: %v", i, err)
+    }
+  }
+}
+
+func TestJWTVerify(t *testing.T) {
+  useMemoryStore(t)
+  resetJWTKeyRing(t)
+  confValue.JWT.Secret = "secret"
+
+  ctx := context.Background()
+  tk := NewJWT(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  claims, err := VerifyJWT(tk.Id())
+  if err != nil || claims.Uid != "u1" || claims.ClientId != "c1" {
+    t.Fatalf("%+v, %v", claims, err)
+  }
+
+  parts := strings.Split(tk.Id(), ".")
+  b64 := base64.RawURLEncoding
+  tests := []struct {
+    name  string
+    token string
+  }{
+    {"alg none", b64.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."},
+    {"alg RS256", b64.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + parts[1] + "." + parts[2]},
+    {"unknown kid", b64.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"x"}`)) + "." + parts[1] + "." + parts[2]},
+    {"bad signature", parts[0] + "." + parts[1] + "." + b64.EncodeToString([]byte("x"))},
+    {"other payload", parts[0] + "." + b64.EncodeToString([]byte(`{"sub":"u2","exp":9999999999}`)) + "." + parts[2]},
+  }
+  for _, test := range tests {
+    if _, err := VerifyJWT(test.token); !errors.Is(err, ErrMalformed) {
+      t.Errorf("%s: %v", test.name, err)
+    }
+  }
+}
+
+func TestKeyRingRotation(t *testing.T) {
+  t0 := time.Unix(1700000000, 0)
+  k1 := NewHMACKey("k1", []byte("secret"))
+  k1.NotBefore = t0
+  k2 := newECKey(t, "k2")
+  k2.NotBefore = t0.Add(10 * time.Minute)
+
+  ring := NewKeyRing(time.Hour)
+  if err := ring.Add(k2, k1); err != nil {
+    t.Fatal(err)
+  }
+  if err := ring.Add(NewHMACKey("k1", []byte("other"))); err == nil {
+    t.Error("add the same kid")
+  }
+
+  sign := func(now time.Time) string {
+    key, err := ring.Signing(now)
+    if err != nil {
+      t.Fatal(err)
+    }
+    token, err := encodeJWT(key, &jwtPayload{Subject: "u1", ClientId: "c1", IssuedAt: now.Unix(),
+      ExpiresAt: now.Add(time.Hour).Unix()})
+    if err != nil {
+      t.Fatal(err)
+    }
+    return token
+  }
+
+  tests := []struct {
+    name   string
+    signAt time.Duration
+    now    time.Duration
+    err    error
+  }{
+    {"k1 before rotation", 5 * time.Minute, 6 * time.Minute, nil},
+    {"k1 after rotation", 5 * time.Minute, 20 * time.Minute, nil},
+    {"k2", 20 * time.Minute, 21 * time.Minute, nil},
+    {"expired", 5 * time.Minute, 66 * time.Minute, ErrExpired},
+    // k1 在 k2 生效 maxTTL 之后退役
+    {"k1 retired", 5 * time.Minute, 71 * time.Minute, ErrMalformed},
+  }
+  for _, test := range tests {
+    token := sign(t0.Add(test.signAt))
+    claims, err := decodeJWT(ring.Verifying, token, t0.Add(test.now))
+    if !errors.Is(err, test.err) || (err == nil && claims.Uid != "u1") {
+      t.Errorf("%s: %+v, %v", test.name, claims, err)
+    }
+  }
+
+  // 还没有生效的 key 已经可以验证，JWKS 中只有 k2
+  if _, ok := ring.Verifying("k2", t0); !ok {
+    t.Error("k2 before NotBefore")
+  }
+  if jwks := ring.JWKS(t0); len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "k2" || jwks.Keys[0].Alg != ES256 {
+    t.Errorf("jwks: %+v", jwks)
+  }
+
+  // 用 k1 的 secret 以 HS256 伪造 k2 的 token
+  parts := strings.Split(sign(t0.Add(20*time.Minute)), ".")
+  header := b64.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"k2"}`))
+  sig, err := k1.sign([]byte(header + "." + parts[1]))
+  if err != nil {
+    t.Fatal(err)
+  }
+  forged := header + "." + parts[1] + "." + b64.EncodeToString(sig)
+  if _, err := decodeJWT(ring.Verifying, forged, t0.Add(21*time.Minute)); !errors.Is(err, ErrMalformed) {
+    t.Errorf("alg substitution: %v", err)
+  }
+}
@@ -0,0 +1,367 @@
+package token
+
+import (
+  "context"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-log/log"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+/**
+ * 签名 key 的轮换：
+ *
+ *   1、KeyRing 中可以有多个 key，以 kid 区分，签名的 token 中记录 kid，验证时使用对应的 key
+ *   2、NotBefore <= now 的 key 中，NotBefore 最晚的一个是当前签名的 key。把新 key 的 NotBefore 设为将来的时间，
+ *      即是定时轮换；在此之前新 key 已经可以用于验证(及发布到 JWKS)
+ *   3、一个 key 不再签名后，它签名的 token 最迟在 maxTTL 后全部过期，此后这个 key 退役，不再用于验证
+ *
+ * key 可以来自 go-config 的配置，也可以来自磁盘上的目录，见 KeyRing.LoadDir
+ */
+
+type Key struct {
+  Kid string
+  Alg string
+  // 生效的时间，零值表示立即生效
+  NotBefore time.Time
+
+  // HS256
+  secret []byte
+  // RS256/ES256，只用于验证的 key 没有 private
+  private crypto.Signer
+  public  crypto.PublicKey
+}
+
+func NewHMACKey(kid string, secret []byte) *Key {
+  return &Key{Kid: kid, Alg: HS256, secret: secret}
+}
+
+// ParsePEMKey 解析 PEM 格式的私钥或者公钥，alg 由 key 的类型决定：RSA 为 RS256，P-256 为 ES256
+func ParsePEMKey(kid string, data []byte) (*Key, error) {
+  block, _ := pem.Decode(data)
+  if block == nil {
+    return nil, errors.New("token key: no PEM data")
+  }
+
+  key := &Key{Kid: kid}
+  if private, err := parsePrivateKey(block.Bytes); err == nil {
+    key.private = private
+    key.public = private.Public()
+  } else if key.public, err = parsePublicKey(block.Bytes); err != nil {
+    return nil, fmt.Errorf("token key: unsupported PEM(%s)", block.Type)
+  }
+
+  switch pub := key.public.(type) {
+  case *rsa.PublicKey:
+    key.Alg = RS256
+  case *ecdsa.PublicKey:
+    if pub.Curve != elliptic.P256() {
+      return nil, errors.New("token key: only P-256 is supported for ecdsa")
+    }
+    key.Alg = ES256
+  default:
+    return nil, fmt.Errorf("token key: unsupported public key %T", pub)
+  }
+
+  return key, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+  if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+    if signer, ok := key.(crypto.Signer); ok {
+      return signer, nil
+    }
+    return nil, errors.New("token key: unsupported private key")
+  }
+  if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+    return key, nil
+  }
+  return x509.ParseECPrivateKey(der)
+}
+
+func parsePublicKey(der []byte) (crypto.PublicKey, error) {
+  if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+    return key, nil
+  }
+  if cert, err := x509.ParseCertificate(der); err == nil {
+    return cert.PublicKey, nil
+  }
+  return x509.ParsePKCS1PublicKey(der)
+}
+
+// Public HS256 的 key 返回 nil
+func (k *Key) Public() crypto.PublicKey {
+  return k.public
+}
+
+func (k *Key) canSign() bool {
+  return k.Alg == HS256 || k.private != nil
+}
+
+func (k *Key) sign(data []byte) ([]byte, error) {
+  sum := sha256.Sum256(data)
+
+  switch k.Alg {
+  case HS256:
+    mac := hmac.New(sha256.New, k.secret)
+    mac.Write(data)
+    return mac.Sum(nil), nil
+  case RS256:
+    if k.private == nil {
+      return nil, fmt.Errorf("token key: key(%s) has no private key to sign", k.Kid)
+    }
+    return k.private.Sign(rand.Reader, sum[:], crypto.SHA256)
+  case ES256:
+    priv, ok := k.private.(*ecdsa.PrivateKey)
+    if !ok {
+      return nil, fmt.Errorf("token key: key(%s) has no private key to sign", k.Kid)
+    }
+    r, s, err := ecdsa.Sign(rand.Reader, priv, sum[:])
+    if err != nil {
+      return nil, err
+    }
+    // JWS 使用 r||s，各 32 字节
+    sig := make([]byte, 64)
+    r.FillBytes(sig[:32])
+    s.FillBytes(sig[32:])
+    return sig, nil
+  }
+
+  return nil, fmt.Errorf("token key: unknown alg(%s)", k.Alg)
+}
+
+func (k *Key) verify(data []byte, sig []byte) bool {
+  sum := sha256.Sum256(data)
+
+  switch k.Alg {
+  case HS256:
+    mac := hmac.New(sha256.New, k.secret)
+    mac.Write(data)
+    return hmac.Equal(sig, mac.Sum(nil))
+  case RS256:
+    pub, ok := k.public.(*rsa.PublicKey)
+    return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+  case ES256:
+    pub, ok := k.public.(*ecdsa.PublicKey)
+    if !ok || len(sig) != 64 {
+      return false
+    }
+    r := new(big.Int).SetBytes(sig[:32])
+    s := new(big.Int).SetBytes(sig[32:])
+    return ecdsa.Verify(pub, sum[:], r, s)
+  }
+
+  return false
+}
+
+type KeyRing struct {
+  mu sync.RWMutex
+  // 按 NotBefore 排序
+  keys   []*Key
+  maxTTL time.Duration
+}
+
+// NewKeyRing maxTTL 为签名的 token 的最长有效期
+func NewKeyRing(maxTTL time.Duration) *KeyRing {
+  return &KeyRing{maxTTL: maxTTL}
+}
+
+// Add kid 已经存在时返回错误
+func (r *KeyRing) Add(keys ...*Key) error {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  for _, key := range keys {
+    for _, k := range r.keys {
+      if k.Kid == key.Kid {
+        return fmt.Errorf("token key: kid(%s) already exists", key.Kid)
+      }
+    }
+    r.keys = append(r.keys, key)
+  }
+
+  sort.SliceStable(r.keys, func(i, j int) bool {
+    return r.keys[i].NotBefore.Before(r.keys[j].NotBefore)
+  })
+  return nil
+}
+
+// Rotate 立即使用 key 签名
+func (r *KeyRing) Rotate(key *Key) error {
+  key.NotBefore = time.Now()
+  return r.Add(key)
+}
+
+func (r *KeyRing) has(kid string) bool {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  for _, k := range r.keys {
+    if k.Kid == kid {
+      return true
+    }
+  }
+  return false
+}
+
+// Signing 当前签名的 key
+func (r *KeyRing) Signing(now time.Time) (*Key, error) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  var current *Key
+  for _, k := range r.keys {
+    if k.NotBefore.After(now) {
+      break
+    }
+    current = k
+  }
+
+  if current == nil {
+    return nil, errors.New("token key: no active key to sign")
+  }
+  if !current.canSign() {
+    return nil, fmt.Errorf("token key: the current key(%s) can not sign", current.Kid)
+  }
+  return current, nil
+}
+
+// 调用者需持有锁。第 i 个 key 是否已经退役
+func (r *KeyRing) retired(i int, now time.Time) bool {
+  if i+1 >= len(r.keys) {
+    return false
+  }
+
+  // 下一个 key 生效时，第 i 个 key 不再签名
+  next := r.keys[i+1].NotBefore
+  return !next.After(now) && !now.Before(next.Add(r.maxTTL))
+}
+
+// Verifying 可用于验证的 key，退役的 key 不再返回
+func (r *KeyRing) Verifying(kid string, now time.Time) (*Key, bool) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  for i, k := range r.keys {
+    if k.Kid == kid {
+      return k, !r.retired(i, now)
+    }
+  }
+  return nil, false
+}
+
+// Active 所有可用于验证的 key，包括还没有生效的
+func (r *KeyRing) Active(now time.Time) []*Key {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  ret := make([]*Key, 0, len(r.keys))
+  for i, k := range r.keys {
+    if !r.retired(i, now) {
+      ret = append(ret, k)
+    }
+  }
+  return ret
+}
+
+// Prune 删除已经退役的 key
+func (r *KeyRing) Prune(now time.Time) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  keys := make([]*Key, 0, len(r.keys))
+  for i, k := range r.keys {
+    if !r.retired(i, now) {
+      keys = append(keys, k)
+    }
+  }
+  r.keys = keys
+}
+
+/**
+ * LoadDir 加载 dir 中所有的 *.pem 文件：
+ *   kid 为文件名(不含 .pem)，alg 由 key 的类型决定，NotBefore 为文件的修改时间。
+ * 已经存在的 kid 不会重复加载，所以可以定时调用(见 StartKeyRingReloader)，放入新的文件即是轮换
+ */
+func (r *KeyRing) LoadDir(dir string) error {
+  files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+  if err != nil {
+    return err
+  }
+
+  for _, file := range files {
+    kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+    if r.has(kid) {
+      continue
+    }
+
+    key, err := loadPEMFile(kid, file)
+    if err != nil {
+      return err
+    }
+    if err = r.Add(key); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func loadPEMFile(kid string, file string) (*Key, error) {
+  data, err := ioutil.ReadFile(file)
+  if err != nil {
+    return nil, err
+  }
+
+  key, err := ParsePEMKey(kid, data)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %w", file, err)
+  }
+
+  info, err := os.Stat(file)
+  if err != nil {
+    return nil, err
+  }
+  key.NotBefore = info.ModTime()
+
+  return key, nil
+}
+
+// StartKeyRingReloader 在后台每隔 interval 从 dir 加载新的 key 并删除已经退役的 key，直到 ctx 结束
+func StartKeyRingReloader(ctx context.Context, ring *KeyRing, dir string, interval time.Duration) {
+  go func() {
+    _, logger := log.WithCtx(ctx)
+    logger.PushPrefix("token key ring")
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case <-ticker.C:
+        if err := ring.LoadDir(dir); err != nil {
+          logger.Error(err)
+        }
+        ring.Prune(time.Now())
+      }
+    }
+  }()
+}
@@ -0,0 +1,96 @@
+package token
+
+import (
+  "context"
+  "errors"
+  "github.com/xpwu/go-api-token/token/db"
+)
+
+/**
+ * 生命周期事件，见 db/observer.go：存储中的 token 的事件由 token/db 产生，直接调用 token/db 的接口同样会通知；
+ * 本包只产生签名的 token(NewStateless、NewJWT、Del)及验证(UidOrInvalid 等)的事件
+ */
+
+type (
+  EventKind    = db.EventKind
+  Event        = db.Event
+  Observer     = db.Observer
+  ObserverFunc = db.ObserverFunc
+)
+
+const (
+  EventNew           = db.EventNew
+  EventReuse         = db.EventReuse
+  EventResumed       = db.EventResumed
+  EventResumeFailed  = db.EventResumeFailed
+  EventEvicted       = db.EventEvicted
+  EventRotated       = db.EventRotated
+  EventRefreshReused = db.EventRefreshReused
+  EventDel           = db.EventDel
+  EventDelClientId   = db.EventDelClientId
+  EventDelAll        = db.EventDelAll
+)
+
+// AddObserver 与 db.AddObserver 相同，应在使用 token 之前调用
+func AddObserver(o Observer) {
+  db.AddObserver(o)
+}
+
+// Redact 只保留 token 的前后几个字符，用于日志等不能泄露 token 的地方
+func Redact(token string) string {
+  return db.Redact(token)
+}
+
+func notify(ctx context.Context, event *Event) {
+  db.Notify(ctx, event)
+}
+
+func observing() bool {
+  return db.Observing()
+}
+
+// notifyResume 只有签名的 token 验证成功时才有 ClientId
+func (t *Token) notifyResume(uid string, err error) {
+  if !observing() {
+    return
+  }
+
+  event := &Event{Kind: EventResumed, Uid: uid, Token: t.Id()}
+  if t.claims != nil {
+    event.ClientId = t.claims.ClientId
+  }
+  if err != nil {
+    event.Kind = EventResumeFailed
+    event.Err = err
+  }
+  var revoked *db.RevokedError
+  if errors.As(err, &revoked) {
+    event.Uid = revoked.Tombstone.Uid
+    event.ClientId = revoked.Tombstone.ClientId
+    event.Reason = revoked.Tombstone.Reason
+  }
+  notify(t.ctx, event)
+}
+
+// DelClientIdForUidWithErr 与 db.DelClientIdForUidWithErr 相同
+func DelClientIdForUidWithErr(ctx context.Context, uid string, clientId string) error {
+  return db.DelClientIdForUidWithErr(ctx, uid, clientId)
+}
+
+func DelClientIdForUid(ctx context.Context, uid string, clientId string) {
+  err := DelClientIdForUidWithErr(ctx, uid, clientId)
+  if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired) {
+    panic(err)
+  }
+}
+
+// DelAllForUidWithErr 与 db.DelAllForUidWithErr 相同
+func DelAllForUidWithErr(ctx context.Context, uid string) error {
+  return db.DelAllForUidWithErr(ctx, uid)
+}
+
+func DelAllForUid(ctx context.Context, uid string) {
+  if err := DelAllForUidWithErr(ctx, uid); err != nil {
+    panic(err)
+  }
+}
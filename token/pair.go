@@ -0,0 +1,126 @@
+package token
+
+import (
+  "context"
+  "fmt"
+  "github.com/xpwu/go-api-token/token/db"
+  "github.com/xpwu/go-log/log"
+  "time"
+)
+
+/**
+ * access token + refresh token：
+ *   access token 有效期短(Pair.AccessTTLMinutes)，每个请求都携带，与 Resume 得到的 token 用法相同；
+ *   refresh token 有效期与普通的 token 相同，占用 uid 的 ClientId，只在换取新的 access token 时使用(RefreshWithErr)，
+ *   Resume、tapi.PostJsonAPI 验证 refresh token 时返回 ErrNotFound。
+ *
+ * 每次换取 access token 时 refresh token 同时轮换，旧的 refresh token 再次使用时，这次登录得到的所有 token 都被撤销。
+ * 两者的存储方式见 db/access.go 及 db/family.go
+ */
+
+// 与 token/db 中的错误相同，见 db/family.go
+var (
+  ErrNotRefreshToken = db.ErrNotRefreshToken
+  ErrRefreshReused   = db.ErrRefreshReused
+)
+
+type Pair struct {
+  Access           *Token
+  Refresh          *Token
+  AccessExpiresAt  time.Time
+  RefreshExpiresAt time.Time
+}
+
+func accessTTL() time.Duration {
+  return time.Duration(confValue.Pair.AccessTTLMinutes) * time.Minute
+}
+
+// newPair 过期时间为写入时实际使用的 TTL，已经考虑了 MaxTTL 及 AbsoluteTTL
+func newPair(access *Token, refresh *Token) *Pair {
+  return &Pair{
+    Access:           access,
+    Refresh:          refresh,
+    AccessExpiresAt:  access.DB.ExpiresAt(),
+    RefreshExpiresAt: refresh.DB.ExpiresAt(),
+  }
+}
+
+func newAccess(ctx context.Context, refresh *db.DB, value db.Value) (*Token, error) {
+  d := db.New(ctx, NewId(value.Uid, value.ClientId))
+  if err := d.SetAccessWithErr(refresh, value, accessTTL()); err != nil {
+    return nil, err
+  }
+  return newToken(ctx, value, d), nil
+}
+
+// NewPairWithErr 与 NewWithErr 相同，会覆盖 value.ClientId 原有的 token
+func NewPairWithErr(ctx context.Context, value db.Value) (*Pair, error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.Debug("new token pair start")
+
+  checkValue(&value)
+
+  value.RefreshOnly = true
+  refresh, err := NewWithErr(ctx, value)
+  if err != nil {
+    return nil, err
+  }
+
+  // 写入时确定了 family
+  stored, err := refresh.DB.ValueWithErr()
+  if err != nil {
+    return nil, err
+  }
+  access, err := newAccess(ctx, refresh.DB, *stored)
+  if err != nil {
+    return nil, err
+  }
+
+  logger.Debug("new token pair end")
+
+  return newPair(access, refresh), nil
+}
+
+func NewPair(ctx context.Context, value db.Value) *Pair {
+  ret, err := NewPairWithErr(ctx, value)
+  if err != nil {
+    panic(err)
+  }
+  return ret
+}
+
+// RefreshWithErr 使用 refresh token 换取新的 access token，同时轮换 refresh token，旧的 refresh token 不再有效。
+// refreshToken 无效时返回 ErrMalformed、ErrNotFound、ErrExpired、ErrNotRefreshToken 或者 ErrRefreshReused
+func RefreshWithErr(ctx context.Context, refreshToken string) (*Pair, error) {
+  ctx, logger := log.WithCtx(ctx)
+
+  if err := checkFormat(refreshToken); err != nil {
+    return nil, err
+  }
+
+  old := db.New(ctx, refreshToken)
+  value, err := old.ValueWithErr()
+  if err != nil {
+    return nil, err
+  }
+  if !value.RefreshOnly {
+    logger.Warning(fmt.Sprintf("token(%s) is not a refresh token", refreshToken))
+    return nil, ErrNotRefreshToken
+  }
+
+  d, err := old.RotateWithErr(NewId(value.Uid, value.ClientId))
+  if err != nil {
+    return nil, err
+  }
+  if value, err = d.ValueWithErr(); err != nil {
+    return nil, err
+  }
+  refresh := newToken(ctx, *value, d)
+
+  access, err := newAccess(ctx, d, *value)
+  if err != nil {
+    return nil, err
+  }
+
+  return newPair(access, refresh), nil
+}
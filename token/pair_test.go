@@ -0,0 +1,82 @@
+package token
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+  "github.com/xpwu/go-api-token/token/db"
+)
+
+func TestRefreshTokenIsNotAccepted(t *testing.T) {
+  useMemoryStore(t)
+
+  ctx := context.Background()
+  pair := NewPair(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+
+  if uid, err := Resume(ctx, pair.Access.Id()).UidOrInvalidWithErr(); err != nil || uid != "u1" {
+    t.Fatalf("access: uid(%s), %v", uid, err)
+  }
+  if _, err := Resume(ctx, pair.Refresh.Id()).UidOrInvalidWithErr(); !errors.Is(err, ErrNotFound) {
+    t.Fatalf("refresh: %v", err)
+  }
+
+  // 验证失败后 refresh token 仍然可以换取新的 access token
+  next, err := RefreshWithErr(ctx, pair.Refresh.Id())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := Resume(ctx, next.Access.Id()).UidOrInvalidWithErr(); err != nil {
+    t.Fatalf("new access: %v", err)
+  }
+  if _, err := Resume(ctx, next.Refresh.Id()).UidOrInvalidWithErr(); !errors.Is(err, ErrNotFound) {
+    t.Fatalf("new refresh: %v", err)
+  }
+}
+
+func TestRefreshAfterNotBefore(t *testing.T) {
+  useMemoryStore(t)
+
+  ctx := context.Background()
+  pair := NewPair(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  db.SetNotBefore(ctx, "u1", time.Now())
+
+  if _, err := RefreshWithErr(ctx, pair.Refresh.Id()); !errors.Is(err, ErrNotFound) {
+    t.Fatalf("refresh: %v", err)
+  }
+}
+
+func TestRefreshAfterSignedOut(t *testing.T) {
+  useMemoryStore(t)
+
+  ctx := context.Background()
+  pair := NewPair(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  DelAllForUid(ctx, "u1")
+
+  _, err := RefreshWithErr(ctx, pair.Refresh.Id())
+  var revoked *db.RevokedError
+  if !errors.As(err, &revoked) || revoked.Tombstone.Reason != db.ReasonSignedOut {
+    t.Fatalf("refresh: %v", err)
+  }
+}
+
+func TestPairExpiresAt(t *testing.T) {
+  useMemoryStore(t)
+
+  ctx := context.Background()
+  now := time.Now()
+  pair := NewPair(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  near := func(name string, at time.Time, expected time.Time) {
+    if d := at.Sub(expected); d < -time.Second || d > time.Second {
+      t.Errorf("%s: %s, expected %s", name, at, expected)
+    }
+  }
+  near("access", pair.AccessExpiresAt, now.Add(accessTTL()))
+  near("refresh", pair.RefreshExpiresAt, now.Add(db.MaxTTL("")))
+
+  next, err := RefreshWithErr(ctx, pair.Refresh.Id())
+  if err != nil {
+    t.Fatal(err)
+  }
+  near("rotated refresh", next.RefreshExpiresAt, now.Add(db.MaxTTL("")))
+}
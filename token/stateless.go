@@ -0,0 +1,248 @@
+package token
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/xpwu/go-api-token/token/db"
+  "github.com/xpwu/go-log/log"
+  "strings"
+  "time"
+)
+
+/**
+ * 无状态 token：token 本身是签名的数据，验证时不需要访问存储
+ *
+ *   s1.<base64url(json(Claims))>.<base64url(HMAC-SHA256(secret, "s1." + payload))>
+ *
+ * 验证时总是检查 Claims.IssuedAtMs 是否早于全局的 NotBefore(见 db.SetGlobalNotBeforeWithErr)，全局的 NotBefore
+ * 在每个进程中缓存，不需要每次访问存储。之前签发的 token 没有 IssuedAtMs，以 IssuedAt 的秒比较。
+ *
+ * 注销(Del)时只能把 Claims.Id 记录到存储中直到 token 过期，配置了 Stateless.CheckRevocation 时，
+ * 验证才会访问存储检查是否已注销，以及 Claims.IssuedAtMs 是否早于 uid 的 NotBefore(见 db.SetNotBeforeWithErr)。
+ * 每次验证需要读两次存储，失去了无状态的意义，所以默认不检查：Del 及 uid 的 NotBefore(比如修改密码)对未过期的
+ * token 不生效，需要立即失效时应使用较短的 ttl 或者开启 CheckRevocation
+ */
+
+const statelessPrefix = "s1."
+
+// ErrRevoked token 已经注销
+var ErrRevoked = errors.New("token: revoked")
+
+// Claims 签名的 token(无状态 token 及 JWT)中的数据
+type Claims struct {
+  Id       string `json:"jti"`
+  Uid      string `json:"uid"`
+  ClientId string `json:"cid"`
+  Session  string `json:"ses,omitempty"`
+  // unix 秒，只有 JWT 才有
+  LatestTime int64 `json:"-"`
+  IssuedAt   int64 `json:"iat"`
+  // unix 毫秒，与 NotBefore 比较，见 db/notbefore.go
+  IssuedAtMs int64 `json:"iatms,omitempty"`
+  ExpiresAt  int64 `json:"exp"`
+}
+
+func (c *Claims) expiresAt() time.Time {
+  return time.Unix(c.ExpiresAt, 0)
+}
+
+// issuedAtMs 之前签发的没有 IssuedAtMs，使用 IssuedAt 所在秒的开始，即同一秒的 NotBefore 之后签发的也无效
+func (c *Claims) issuedAtMs() int64 {
+  if c.IssuedAtMs > 0 {
+    return c.IssuedAtMs
+  }
+  return c.IssuedAt * 1000
+}
+
+func isStateless(token string) bool {
+  return strings.HasPrefix(token, statelessPrefix)
+}
+
+// isSigned 无状态 token 或者 JWT
+func isSigned(token string) bool {
+  return isStateless(token) || isJWT(token)
+}
+
+func decodeSigned(token string, now time.Time) (*Claims, error) {
+  if isJWT(token) {
+    return decodeJWT(verifyingJWTKey, token, now)
+  }
+  return decodeStateless(token, now)
+}
+
+// ErrStatelessNotConfigured 没有配置 stateless.secret，不能生成无状态的 token
+var ErrStatelessNotConfigured = errors.New("token: stateless.secret is not set")
+
+func statelessSecret() ([]byte, error) {
+  if confValue.Stateless.Secret == "" {
+    return nil, ErrStatelessNotConfigured
+  }
+  return []byte(confValue.Stateless.Secret), nil
+}
+
+func sign(secret []byte, data string) string {
+  mac := hmac.New(sha256.New, secret)
+  mac.Write([]byte(data))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeStateless(claims *Claims) (string, error) {
+  secret, err := statelessSecret()
+  if err != nil {
+    return "", err
+  }
+
+  payload, err := json.Marshal(claims)
+  if err != nil {
+    return "", err
+  }
+
+  data := statelessPrefix + base64.RawURLEncoding.EncodeToString(payload)
+  return data + "." + sign(secret, data), nil
+}
+
+// decodeStateless 签名不对返回 ErrMalformed，过期返回 ErrExpired。
+// 没有配置 stateless.secret 时不可能签发过无状态的 token，同样返回 ErrMalformed
+func decodeStateless(token string, now time.Time) (*Claims, error) {
+  secret, err := statelessSecret()
+  if err != nil {
+    return nil, ErrMalformed
+  }
+
+  i := strings.LastIndex(token, ".")
+  if !isStateless(token) || i < len(statelessPrefix) {
+    return nil, ErrMalformed
+  }
+
+  data, sig := token[:i], token[i+1:]
+  if !hmac.Equal([]byte(sig), []byte(sign(secret, data))) {
+    return nil, ErrMalformed
+  }
+
+  payload, err := base64.RawURLEncoding.DecodeString(data[len(statelessPrefix):])
+  if err != nil {
+    return nil, ErrMalformed
+  }
+
+  claims := &Claims{}
+  if err = json.Unmarshal(payload, claims); err != nil {
+    return nil, ErrMalformed
+  }
+
+  if !now.Before(claims.expiresAt()) {
+    return nil, ErrExpired
+  }
+
+  return claims, nil
+}
+
+func statelessTTL() time.Duration {
+  return time.Duration(confValue.Stateless.TTLMinutes) * time.Minute
+}
+
+// NewStatelessWithErr 生成无状态的 token，不访问存储。没有配置 stateless.secret 时返回 ErrStatelessNotConfigured
+func NewStatelessWithErr(ctx context.Context, value db.Value) (*Token, error) {
+  _, logger := log.WithCtx(ctx)
+
+  checkValue(&value)
+
+  now := db.IssuedAtNow()
+  claims := &Claims{
+    Id:         currentIDGenerator().NewId(value.Uid, value.ClientId),
+    Uid:        value.Uid,
+    ClientId:   value.ClientId,
+    Session:    value.Session,
+    IssuedAt:   now.Unix(),
+    IssuedAtMs: now.UnixNano() / int64(time.Millisecond),
+    ExpiresAt:  now.Add(statelessTTL()).Unix(),
+  }
+
+  token, err := encodeStateless(claims)
+  if err != nil {
+    logger.Error(err)
+    return nil, err
+  }
+
+  logger.Info(fmt.Sprintf("[uid(%s), clientid(%s)]=>stateless token(%s)", value.Uid,
+    value.ClientId, claims.Id))
+
+  ret := &Token{DB: db.New(ctx, token), ctx: ctx, claims: claims}
+  notify(ctx, &Event{Kind: EventNew, Uid: value.Uid, ClientId: value.ClientId, Token: ret.Id()})
+  ret.uid = func() string {
+    return claims.Uid
+  }
+  return ret, nil
+}
+
+// NewStateless 生成无状态的 token，不访问存储
+func NewStateless(ctx context.Context, value db.Value) *Token {
+  ret, err := NewStatelessWithErr(ctx, value)
+  if err != nil {
+    panic(err)
+  }
+  return ret
+}
+
+// verifySigned 验证签名、有效期及全局的 NotBefore，配置了 CheckRevocation 时检查是否已注销及 uid 的 NotBefore
+func (t *Token) verifySigned() (*Claims, error) {
+  if t.claims != nil {
+    return t.claims, nil
+  }
+
+  claims, err := decodeSigned(t.Id(), time.Now())
+  if err != nil {
+    return nil, err
+  }
+
+  checkRevocation := confValue.Stateless.CheckRevocation
+  if isJWT(t.Id()) {
+    checkRevocation = confValue.JWT.CheckRevocation
+  }
+
+  notBefore := db.GlobalNotBefore(t.ctx)
+  if checkRevocation {
+    revoked, err := db.IsRevokedWithErr(t.ctx, claims.Id)
+    if err != nil {
+      return nil, err
+    }
+    if revoked {
+      return nil, ErrRevoked
+    }
+
+    // 包括全局的 NotBefore
+    notBefore, err = db.NotBeforeWithErr(t.ctx, claims.Uid)
+    if err != nil && !errors.Is(err, db.ErrNotBeforeNotSupported) {
+      return nil, err
+    }
+  }
+  if !notBefore.IsZero() && claims.issuedAtMs() <= notBefore.UnixNano()/int64(time.Millisecond) {
+    return nil, ErrRevoked
+  }
+
+  t.claims = claims
+  return claims, nil
+}
+
+// Claims 只有签名的 token 才有，并且需要先通过验证(比如 UidOrInvalid)
+func (t *Token) Claims() (claims *Claims, ok bool) {
+  return t.claims, t.claims != nil
+}
+
+func (t *Token) delSigned() error {
+  claims, err := decodeSigned(t.Id(), time.Now())
+  if err != nil {
+    // 已经无效，不需要注销
+    return nil
+  }
+
+  if err = db.RevokeWithErr(t.ctx, claims.Id, time.Until(claims.expiresAt())); err != nil {
+    return err
+  }
+  notify(t.ctx, &Event{Kind: EventDel, Uid: claims.Uid, ClientId: claims.ClientId, Token: t.Id()})
+  return nil
+}
@@ -0,0 +1,93 @@
+package token
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+  "github.com/xpwu/go-api-token/token/db"
+)
+
+func TestStatelessWithoutSecret(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Stateless.Secret = ""
+
+  ctx := context.Background()
+  if _, err := NewStatelessWithErr(ctx, db.Value{Uid: "u1", ClientId: "c1"}); !errors.Is(err, ErrStatelessNotConfigured) {
+    t.Fatalf("NewStatelessWithErr: %v", err)
+  }
+
+  for _, tk := range []string{"s1.x.y", "s1.", "s1.eyJ1aWQiOiJ1MSJ9.sig"} {
+    if _, err := Resume(ctx, tk).UidOrInvalidWithErr(); !errors.Is(err, ErrMalformed) {
+      t.Errorf("%s: %v", tk, err)
+    }
+    if _, ok := Resume(ctx, tk).UidOrInvalid(); ok {
+      t.Errorf("%s: valid", tk)
+    }
+  }
+}
+
+func TestStatelessRoundTrip(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Stateless.Secret = "secret"
+  confValue.Stateless.CheckRevocation = true
+
+  ctx := context.Background()
+  tk := NewStateless(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  uid, err := Resume(ctx, tk.Id()).UidOrInvalidWithErr()
+  if err != nil || uid != "u1" {
+    t.Fatalf("uid(%s), %v", uid, err)
+  }
+
+  forged := tk.Id()[:len(tk.Id())-2] + "xx"
+  if _, err := Resume(ctx, forged).UidOrInvalidWithErr(); !errors.Is(err, ErrMalformed) {
+    t.Errorf("forged: %v", err)
+  }
+
+  tk.Del()
+  if _, err := Resume(ctx, tk.Id()).UidOrInvalidWithErr(); !errors.Is(err, ErrRevoked) {
+    t.Errorf("deleted: %v", err)
+  }
+}
+
+func TestStatelessWithoutRevocation(t *testing.T) {
+  useMemoryStore(t)
+  confValue.Stateless.Secret = "secret"
+
+  ctx := context.Background()
+  tk := NewStateless(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  tk.Del()
+  // 默认不访问存储，注销对未过期的 token 不生效
+  if uid, err := Resume(ctx, tk.Id()).UidOrInvalidWithErr(); err != nil || uid != "u1" {
+    t.Errorf("uid(%s), %v", uid, err)
+  }
+}
+
+func TestSignedGlobalNotBefore(t *testing.T) {
+  useMemoryStore(t)
+  resetJWTKeyRing(t)
+  confValue.Stateless.Secret = "secret"
+  confValue.JWT.Secret = "secret"
+
+  ctx := context.Background()
+  stateless := NewStateless(ctx, db.Value{Uid: "u1", ClientId: "c1"})
+  jwt := NewJWT(ctx, db.Value{Uid: "u1", ClientId: "c2"})
+
+  // 没有开启 CheckRevocation 时，uid 的 NotBefore 需要读取存储，不检查
+  db.SetNotBefore(ctx, "u1", time.Now())
+  for _, tk := range []*Token{stateless, jwt} {
+    if _, err := Resume(ctx, tk.Id()).UidOrInvalidWithErr(); err != nil {
+      t.Errorf("uid not-before: %v", err)
+    }
+  }
+
+  db.SetGlobalNotBefore(ctx, time.Now())
+  for _, tk := range []*Token{stateless, jwt} {
+    if _, err := Resume(ctx, tk.Id()).UidOrInvalidWithErr(); !errors.Is(err, ErrRevoked) {
+      t.Errorf("global not-before: %v", err)
+    }
+  }
+  if _, err := Resume(ctx, NewStateless(ctx, db.Value{Uid: "u1", ClientId: "c1"}).Id()).UidOrInvalidWithErr(); err != nil {
+    t.Errorf("issued after: %v", err)
+  }
+}
@@ -2,18 +2,27 @@ package token
 
 import (
   "context"
-  "crypto/hmac"
-  "crypto/sha1"
-  "encoding/hex"
+  "errors"
   "fmt"
   "github.com/xpwu/go-api-token/token/db"
   "github.com/xpwu/go-log/log"
-  "github.com/xpwu/go-reqid/reqid"
+)
+
+// 与 token/db 中的错误相同，可使用 errors.Is 判断
+var (
+  ErrNotFound         = db.ErrNotFound
+  ErrExpired          = db.ErrExpired
+  ErrStoreUnavailable = db.ErrStoreUnavailable
+  ErrTooManyDevices   = db.ErrTooManyDevices
+  ErrHashedToken      = db.ErrHashedToken
 )
 
 type Token struct {
   DB  *db.DB
-  uid func()string
+  uid func() string
+  ctx context.Context
+  // 只有签名的 token 才有，见 stateless.go 及 jwt.go
+  claims *Claims
 }
 
 // Id 返回token的值，常用于传递给客户端
@@ -21,21 +30,43 @@ func (t *Token) Id() string {
   return t.DB.RealToken()
 }
 
-// UidOrInvalid
-// ok true: token is valid, false: invalid
-func (t *Token) UidOrInvalid() (uid string, ok bool) {
-  uid, ok = t.DB.Uid()
-  if ok {
+// UidOrInvalidWithErr token 无效时返回 ErrMalformed、ErrNotFound、ErrExpired 或者 ErrRevoked
+func (t *Token) UidOrInvalidWithErr() (uid string, err error) {
+  switch {
+  case isSigned(t.Id()):
+    var claims *Claims
+    if claims, err = t.verifySigned(); err == nil {
+      uid = claims.Uid
+    }
+  default:
+    if err = checkFormat(t.Id()); err != nil {
+      return "", err
+    }
+    uid, err = t.DB.UidWithErr()
+  }
+
+  if err == nil {
     t.uid = func() string {
       return uid
     }
   }
+  t.notifyResume(uid, err)
 
   return
 }
 
+// UidOrInvalid
+// ok true: token is valid, false: invalid
+func (t *Token) UidOrInvalid() (uid string, ok bool) {
+  uid, err := t.UidOrInvalidWithErr()
+  if errors.Is(err, ErrStoreUnavailable) {
+    panic(err)
+  }
+  return uid, err == nil
+}
+
 func (t *Token) mustUid() string {
-  uid, ok := t.DB.Uid()
+  uid, ok := t.UidOrInvalid()
   if !ok {
     panic(fmt.Sprintf("token(%s) does not have uid", t.DB.RealToken()))
   }
@@ -46,15 +77,36 @@ func (t *Token) Uid() string {
   return t.uid()
 }
 
+// Evicted 生成 token(New、NewOrUseOld)时，因设备数限制而淘汰的其他 token，见 db.EvictionStrategy
+func (t *Token) Evicted() []db.Device {
+  return t.DB.Evicted()
+}
+
+// SlideWithErr 按配置刷新 token 的 TTL 及 LatestTime，见 db.DB.SlideWithErr。签名的 token 有效期固定，不刷新
+func (t *Token) SlideWithErr() error {
+  if isSigned(t.Id()) {
+    return nil
+  }
+  _, err := t.DB.SlideWithErr()
+  return err
+}
+
+// DelWithErr 退出登录时，应该调用此接口删除token数据，可重复多次调用
+func (t *Token) DelWithErr() error {
+  if !isSigned(t.Id()) {
+    return t.DB.DelWithErr()
+  }
+  return t.delSigned()
+}
+
 // Del 退出登录时，应该调用此接口删除token数据，可重复多次调用
 func (t *Token) Del() {
-  t.DB.Del()
+  if err := t.DelWithErr(); err != nil {
+    panic(err)
+  }
 }
 
-func New(ctx context.Context, value db.Value) *Token {
-  ctx, logger := log.WithCtx(ctx)
-  logger.Debug("new token start")
-
+func checkValue(value *db.Value) {
   if value.Uid == "" {
     panic("uid is empty")
   }
@@ -62,65 +114,102 @@ func New(ctx context.Context, value db.Value) *Token {
   if value.ClientId == "" {
     panic("ClientId is empty")
   }
+}
 
-  newToken := NewId(value.Uid, value.ClientId)
-
-  d := db.New(ctx, newToken)
-  d.OverWrite(&value)
-
-  logger.Debug("new token end")
-
-  return &Token{DB: d, uid: func() string {
+func newToken(ctx context.Context, value db.Value, d *db.DB) *Token {
+  return &Token{DB: d, ctx: ctx, uid: func() string {
     return value.Uid
   }}
 }
 
-func NewOrUseOld(ctx context.Context, value db.Value) *Token {
+func NewWithErr(ctx context.Context, value db.Value) (*Token, error) {
   ctx, logger := log.WithCtx(ctx)
   logger.Debug("new token start")
 
-  if value.Uid == "" {
-    panic("uid is empty")
+  checkValue(&value)
+
+  d := db.New(ctx, NewId(value.Uid, value.ClientId))
+  if err := d.OverWriteWithErr(&value); err != nil {
+    return nil, err
   }
+  logger.Debug("new token end")
 
-  if value.ClientId == "" {
-    panic("ClientId is empty")
+  return newToken(ctx, value, d), nil
+}
+
+func New(ctx context.Context, value db.Value) *Token {
+  ret, err := NewWithErr(ctx, value)
+  if err != nil {
+    panic(err)
   }
+  return ret
+}
 
-  newToken := NewId(value.Uid, value.ClientId)
+func NewOrUseOldWithErr(ctx context.Context, value db.Value) (*Token, error) {
+  ctx, logger := log.WithCtx(ctx)
+  logger.Debug("new token start")
 
-  d := db.New(ctx, newToken)
-  d.SetOrUseOld(&value)
+  checkValue(&value)
 
+  id := NewId(value.Uid, value.ClientId)
+  d := db.New(ctx, id)
+  if err := d.SetOrUseOldWithErr(&value); err != nil {
+    return nil, err
+  }
   logger.Debug("new token end")
 
-  return &Token{DB: d, uid: func() string {
-    return value.Uid
-  }}
+  return newToken(ctx, value, d), nil
+}
+
+func NewOrUseOld(ctx context.Context, value db.Value) *Token {
+  ret, err := NewOrUseOldWithErr(ctx, value)
+  if err != nil {
+    panic(err)
+  }
+  return ret
+}
+
+// ResumeWithErr 与 Resume 不同，会立即检查 token 是否有效，无效时返回 ErrMalformed、ErrNotFound 或者 ErrExpired
+func ResumeWithErr(ctx context.Context, token string) (*Token, error) {
+  ret := &Token{DB: db.New(ctx, token), ctx: ctx}
+  if _, err := ret.UidOrInvalidWithErr(); err != nil {
+    return nil, err
+  }
+  return ret, nil
 }
 
 func Resume(ctx context.Context, token string) *Token {
-  ret := &Token{DB: db.New(ctx, token)}
+  ret := &Token{DB: db.New(ctx, token), ctx: ctx}
   ret.uid = ret.mustUid
   return ret
 }
 
-func ResumeFromUidClientId(ctx context.Context, uid, clientId string) (token *Token, ok bool) {
-  d, ok := db.Find(ctx, uid, clientId)
-  if !ok {
-    return nil, false
+// ResumeFromUidClientIdWithErr 没有对应的 token 时返回 ErrNotFound；配置了 hashTokens.secret(见 db/hash.go)时，
+// 存储中没有 token 本身，无法得到 Id()，返回 ErrHashedToken
+func ResumeFromUidClientIdWithErr(ctx context.Context, uid, clientId string) (*Token, error) {
+  d, err := db.FindWithErr(ctx, uid, clientId)
+  if err != nil {
+    return nil, err
+  }
+  if d.RealToken() == "" {
+    return nil, ErrHashedToken
   }
 
-  ret := &Token{DB: d}
+  ret := &Token{DB: d, ctx: ctx}
   ret.uid = func() string {
     return uid
   }
-  return ret, true
+  return ret, nil
 }
 
-func NewId(uid, clientId string) string {
-  hash := hmac.New(sha1.New, []byte(uid))
-  hash.Write([]byte(clientId))
-  hash.Write([]byte(reqid.RandomID()))
-  return hex.EncodeToString(hash.Sum([]byte{}))
+// ResumeFromUidClientId 没有对应的 token 时返回 false，其他错误(包括 ErrHashedToken) panic
+func ResumeFromUidClientId(ctx context.Context, uid, clientId string) (token *Token, ok bool) {
+  token, err := ResumeFromUidClientIdWithErr(ctx, uid, clientId)
+  if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+    return nil, false
+  }
+  if err != nil {
+    panic(err)
+  }
+  return token, true
 }
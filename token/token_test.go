@@ -0,0 +1,16 @@
+package token
+
+import (
+  "testing"
+  "github.com/xpwu/go-api-token/token/db"
+)
+
+// useMemoryStore 每个测试使用新的 memory store，并在结束时恢复配置
+func useMemoryStore(t *testing.T) {
+  db.SetStore(db.NewMemoryStore())
+
+  saved := *confValue
+  t.Cleanup(func() {
+    *confValue = saved
+  })
+}